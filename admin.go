@@ -0,0 +1,727 @@
+package okanoworld
+
+import(
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+)
+
+/**
+ * 管理者からのリクエストかどうかを確認する
+ * 管理者としてログインしているか、cron からの呼び出しなら許可する
+ * 許可しない場合はエラーを応答する
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @returns {bool} 許可する場合は true
+ */
+func requireAdmin(c appengine.Context, w http.ResponseWriter, r *http.Request) bool {
+	if user.IsAdmin(c) || r.Header.Get("X-AppEngine-Cron") == "true" {
+		return true
+	}
+	writeError(c, w, http.StatusForbidden, "管理者のみ実行できます")
+	return false
+}
+
+/**
+ * 一度に削除するエンティティの件数
+ * 大きなランキングは何度かに分けて削除する
+ */
+const wipeBatchSize = 200
+
+/**
+ * banPlayer で一度に取り除くエンティティの件数
+ */
+const banBatchSize = 200
+
+/**
+ * deletePlayer、deleteEntry で一度に削除するエンティティの件数
+ */
+const removeBatchSize = 200
+
+/**
+ * 管理者の操作の記録
+ * datastore には kind "Audit" として保存する
+ * @class
+ * @member {string} Admin 操作した管理者（cron からの呼び出しなら cron）
+ * @member {string} Action 操作の種類
+ * @member {string} Kind 対象のランキング
+ * @member {string} Target 対象のエンティティやプレイヤー
+ * @member {string} Detail 操作の詳細
+ * @member {time.Time} Created 操作日時
+ */
+type Audit struct {
+	Admin string
+	Action string
+	Kind string
+	Target string
+	Detail string
+	Created time.Time
+}
+
+/**
+ * 出場停止中のプレイヤー
+ * datastore には kind "Ban"、プレイヤー名をキー名として保存する
+ * @class
+ * @member {string} Reason 理由
+ * @member {string} Admin 出場停止にした管理者
+ * @member {time.Time} Created 出場停止にした日時
+ */
+type Ban struct {
+	Reason string
+	Admin string
+	Created time.Time
+}
+
+/**
+ * 出場停止中のプレイヤーのランキングデータ
+ * 出場停止の間はランキングから取り除いてここへ移す
+ * datastore には kind "Hidden"、出場停止のキーを親、元のキーを文字列にしたものをキー名として保存する
+ * @class
+ * @member {*datastore.Key} Key 元のエンティティのキー
+ * @member {Entity} Entry 元のランキングデータ
+ */
+type Hidden struct {
+	Key *datastore.Key
+	Entry Entity
+}
+
+/**
+ * banPlayer の応答
+ * @member {int} Hidden 取り除いた件数
+ * @member {int} Index 次に呼び出すときに指定する kind の番号
+ * @member {bool} Done すべて取り除き終わったかどうか（false なら Index を指定してもう一度呼び出す）
+ */
+type BanResult struct {
+	Hidden int
+	Index int
+	Done bool
+}
+
+/**
+ * unbanPlayer の応答
+ * @member {int} Restored 元のランキングに戻した件数
+ * @member {bool} Done すべて戻し終わったかどうか（false ならもう一度呼び出す）
+ */
+type UnbanResult struct {
+	Restored int
+	Done bool
+}
+
+/**
+ * deletePlayer、deleteEntry の応答
+ * @member {int} Deleted 削除した件数
+ * @member {bool} Done すべて削除し終わったかどうか（false ならもう一度呼び出す）
+ */
+type DeleteResult struct {
+	Deleted int
+	Done bool
+}
+
+/**
+ * wipeBoard の応答
+ * @member {int} Deleted 削除した件数
+ * @member {int} Archived アーカイブにコピーした件数
+ * @member {bool} Done すべて削除し終わったかどうか（false ならもう一度呼び出す）
+ */
+type WipeResult struct {
+	Deleted int
+	Archived int
+	Done bool
+}
+
+/**
+ * 操作した管理者の名前を返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @returns {string} 管理者のメールアドレス、cron からの呼び出しなら cron
+ */
+func adminName(c appengine.Context) string {
+	var u *user.User
+	u = user.Current(c)
+	if u == nil {
+		return "cron"
+	}
+	return u.Email
+}
+
+/**
+ * 管理者の操作を記録する
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} action 操作の種類
+ * @param {string} kind 対象のランキング
+ * @param {string} target 対象のエンティティやプレイヤー
+ * @param {string} detail 操作の詳細
+ */
+func audit(c appengine.Context, action string, kind string, target string, detail string) {
+	var record *Audit
+	var err error
+	
+	record = new(Audit)
+	record.Admin = adminName(c)
+	record.Action = action
+	record.Kind = kind
+	record.Target = target
+	record.Detail = detail
+	record.Created = time.Now()
+	c.Infof("audit: %s %s %s %s (%s)", record.Admin, action, kind, target, detail)
+	_, err = datastore.Put(c, datastore.NewIncompleteKey(c, "Audit", nil), record)
+	check(c, err)
+}
+
+/**
+ * 管理者の操作の記録を新しい順に取得する
+ * 管理者のみ実行できる
+ * /getaudit?limit=100
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func getAudit(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var limit int
+	var records []*Audit
+	var err error
+	
+	c = appengine.NewContext(r)
+	if !requireAdmin(c, w, r) {
+		return
+	}
+	
+	limit = 100
+	if r.FormValue("limit") != "" {
+		limit, err = strconv.Atoi(r.FormValue("limit"))
+		if err != nil || limit <= 0 {
+			writeError(c, w, http.StatusBadRequest, "limit が正しくありません")
+			return
+		}
+	}
+	
+	records = make([]*Audit, 0)
+	_, err = datastore.NewQuery("Audit").Order("-Created").Limit(limit).GetAll(c, &records)
+	check(c, err)
+	
+	writeJSON(c, w, records)
+}
+
+/**
+ * ランキングのエンティティを1件削除する
+ * 期間別ランキングやシーズンにコピーされた同じ送信も削除する
+ * 一度に removeBatchSize 件ずつ削除するので、Done が true になるまで同じ key で繰り返し呼び出す（指定したエンティティは最後に削除する）
+ * 管理者のみ実行できる
+ * /deleteentry?key=xxxxxx
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func deleteEntry(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var key *datastore.Key
+	var entity *Entity
+	var board *Board
+	var result *DeleteResult
+	var err error
+	
+	c = appengine.NewContext(r)
+	if !requireAdmin(c, w, r) {
+		return
+	}
+	
+	key, err = datastore.DecodeKey(r.FormValue("key"))
+	if err != nil {
+		writeError(c, w, http.StatusBadRequest, "key が正しくありません")
+		return
+	}
+	board, err = loadBoard(c, strings.SplitN(key.Kind(), "@", 2)[0])
+	if err != nil {
+		writeError(c, w, http.StatusNotFound, "ランキングが見つかりません")
+		return
+	}
+	entity = new(Entity)
+	err = datastore.Get(c, key, entity)
+	if err != nil {
+		writeError(c, w, http.StatusNotFound, "エンティティが見つかりません")
+		return
+	}
+	
+	// 指定したエンティティが残っていれば続きから呼び出せるので、それ以外を先に削除する
+	result = new(DeleteResult)
+	result.Deleted, result.Done, err = board.removeEntries(c, entity.Name, func(k *datastore.Key, e *Entity) bool {
+		return !k.Equal(key) && e.Score == entity.Score && e.Created.Equal(entity.Created)
+	})
+	check(c, err)
+	if err == nil && result.Done {
+		err = board.deleteEntities(c, key.Kind(), []*datastore.Key{key}, []*Entity{entity})
+		check(c, err)
+		if err == nil {
+			result.Deleted++
+			check(c, board.refreshAggregates(c, entity.Name, nil))
+		}
+	}
+	if err != nil {
+		writeError(c, w, http.StatusInternalServerError, "エンティティを削除できませんでした")
+		return
+	}
+	audit(c, "deleteentry", board.ID, r.FormValue("key"), fmt.Sprintf("%s %d, %d件", entity.Name, entity.Score, result.Deleted))
+	
+	writeJSON(c, w, result)
+}
+
+/**
+ * プレイヤーのエンティティをすべて削除する
+ * 一度に removeBatchSize 件ずつ削除するので、Done が true になるまで繰り返し呼び出す
+ * 管理者のみ実行できる
+ * /deleteplayer?kind=xxxxxx&name=xxxxxx
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func deletePlayer(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var board *Board
+	var name string
+	var result *DeleteResult
+	var err error
+	
+	c = appengine.NewContext(r)
+	if !requireAdmin(c, w, r) {
+		return
+	}
+	board = requestBoard(c, w, r)
+	if board == nil {
+		return
+	}
+	name = r.FormValue("name")
+	if name == "" {
+		writeError(c, w, http.StatusBadRequest, "name が指定されていません")
+		return
+	}
+	
+	result = new(DeleteResult)
+	result.Deleted, result.Done, err = board.removeEntries(c, name, func(k *datastore.Key, e *Entity) bool {
+		return true
+	})
+	check(c, err)
+	if err != nil {
+		writeError(c, w, http.StatusInternalServerError, "エンティティを削除できませんでした")
+		return
+	}
+	audit(c, "deleteplayer", board.ID, name, fmt.Sprintf("%d件", result.Deleted))
+	
+	writeJSON(c, w, result)
+}
+
+/**
+ * プレイヤーのエンティティのうち条件に合うものをすべての kind から削除する
+ * 一度に削除するのは removeBatchSize 件まで
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} name プレイヤー名
+ * @param {func(*datastore.Key, *Entity) bool} match 削除するエンティティなら true を返す関数
+ * @returns {int} 削除した件数
+ * @returns {bool} 条件に合うエンティティをすべて削除し終わったかどうか
+ * @returns {error} エラー
+ */
+func (this *Board) removeEntries(c appengine.Context, name string, match func(*datastore.Key, *Entity) bool) (int, bool, error) {
+	var kinds []string
+	var iterator *datastore.Iterator
+	var key *datastore.Key
+	var entity *Entity
+	var targets []*datastore.Key
+	var removed []*Entity
+	var count int
+	var i int
+	var err error
+	
+	kinds, err = this.kinds(c)
+	if err != nil {
+		return 0, false, err
+	}
+	for i = 0; i < len(kinds) && count < removeBatchSize; i++ {
+		// 条件に合わないエンティティは残るので、Limit ではなく読みながら件数を数える
+		targets = nil
+		removed = nil
+		iterator = datastore.NewQuery(kinds[i]).Filter("Name =", name).Run(c)
+		for count + len(targets) < removeBatchSize {
+			entity = new(Entity)
+			key, err = iterator.Next(entity)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				return count, false, err
+			}
+			if match(key, entity) {
+				targets = append(targets, key)
+				removed = append(removed, entity)
+			}
+		}
+		err = this.deleteEntities(c, kinds[i], targets, removed)
+		if err != nil {
+			return count, false, err
+		}
+		count += len(targets)
+	}
+	if count > 0 {
+		check(c, this.refreshAggregates(c, name, nil))
+	}
+	return count, count < removeBatchSize, nil
+}
+
+/**
+ * 1つの kind からエンティティを削除し、統計とキャッシュに反映する
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} kind 削除する kind
+ * @param {[]*datastore.Key} keys 削除するエンティティのキー
+ * @param {[]*Entity} entities 削除するエンティティ
+ * @returns {error} エラー
+ */
+func (this *Board) deleteEntities(c appengine.Context, kind string, keys []*datastore.Key, entities []*Entity) error {
+	var err error
+	if len(keys) == 0 {
+		return nil
+	}
+	err = datastore.DeleteMulti(c, keys)
+	if err != nil {
+		return err
+	}
+	check(c, this.updateStats(c, kind, nil, entities))
+	invalidateTop(c, kind)
+	return nil
+}
+
+/**
+ * プレイヤーが出場停止中かどうか
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} name プレイヤー名
+ * @returns {bool} 出場停止中なら true
+ */
+func isBanned(c appengine.Context, name string) bool {
+	var err error
+	if name == "" {
+		return false
+	}
+	err = datastore.Get(c, datastore.NewKey(c, "Ban", name, 0, nil), new(Ban))
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		check(c, err)
+	}
+	return err == nil
+}
+
+/**
+ * プレイヤーを出場停止にする
+ * 以後の putRanking を拒否し、すべてのランキングからプレイヤーのエンティティを取り除く
+ * 一度に banBatchSize 件ずつ取り除くので、Done が true になるまで Index を渡して繰り返し呼び出す
+ * 管理者のみ実行できる
+ * /banplayer?name=xxxxxx&reason=xxxxxx
+ * /banplayer?name=xxxxxx&index=3
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func banPlayer(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var name string
+	var ban *Ban
+	var banKey *datastore.Key
+	var boards []*Board
+	var kinds []string
+	var owners []*Board
+	var allKinds []string
+	var result *BanResult
+	var i, j, k int
+	var err error
+	
+	c = appengine.NewContext(r)
+	if !requireAdmin(c, w, r) {
+		return
+	}
+	name = r.FormValue("name")
+	if name == "" {
+		writeError(c, w, http.StatusBadRequest, "name が指定されていません")
+		return
+	}
+	
+	result = new(BanResult)
+	banKey = datastore.NewKey(c, "Ban", name, 0, nil)
+	ban = new(Ban)
+	if r.FormValue("index") == "" {
+		ban.Reason = r.FormValue("reason")
+		ban.Admin = adminName(c)
+		ban.Created = time.Now()
+		_, err = datastore.Put(c, banKey, ban)
+	} else {
+		result.Index, err = strconv.Atoi(r.FormValue("index"))
+		if err != nil || result.Index < 0 {
+			writeError(c, w, http.StatusBadRequest, "index が正しくありません")
+			return
+		}
+		err = datastore.Get(c, banKey, ban)
+		if err == datastore.ErrNoSuchEntity {
+			writeError(c, w, http.StatusNotFound, "このプレイヤーは出場停止になっていません")
+			return
+		}
+	}
+	check(c, err)
+	if err != nil {
+		writeError(c, w, http.StatusInternalServerError, "出場停止にできませんでした")
+		return
+	}
+	
+	// すべてのランキングの kind を1列に並べ、Index 番目から続ける
+	boards, err = loadBoards(c)
+	check(c, err)
+	for i = 0; i < len(boards); i++ {
+		kinds, err = boards[i].kinds(c)
+		check(c, err)
+		for j = 0; j < len(kinds); j++ {
+			owners = append(owners, boards[i])
+			allKinds = append(allKinds, kinds[j])
+		}
+	}
+	
+	for ; result.Index < len(allKinds) && result.Hidden < banBatchSize; result.Index++ {
+		var keys []*datastore.Key
+		var entities []*Entity
+		var hiddenKeys []*datastore.Key
+		var hiddens []*Hidden
+		keys, err = datastore.NewQuery(allKinds[result.Index]).Filter("Name =", name).Limit(banBatchSize - result.Hidden).GetAll(c, &entities)
+		check(c, err)
+		if err != nil {
+			break
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		// 元のキーをキー名にして、やり直しても Hidden が重複しないようにする
+		hiddenKeys = make([]*datastore.Key, len(keys))
+		hiddens = make([]*Hidden, len(keys))
+		for k = 0; k < len(keys); k++ {
+			hiddenKeys[k] = datastore.NewKey(c, "Hidden", keys[k].Encode(), 0, banKey)
+			hiddens[k] = new(Hidden)
+			hiddens[k].Key = keys[k]
+			hiddens[k].Entry = *entities[k]
+		}
+		_, err = datastore.PutMulti(c, hiddenKeys, hiddens)
+		check(c, err)
+		if err != nil {
+			break
+		}
+		err = datastore.DeleteMulti(c, keys)
+		check(c, err)
+		if err != nil {
+			break
+		}
+		check(c, owners[result.Index].updateStats(c, allKinds[result.Index], nil, entities))
+		invalidateTop(c, allKinds[result.Index])
+		result.Hidden += len(keys)
+		if result.Hidden >= banBatchSize {
+			// この kind に残りがあるかもしれないので、次も同じ kind から続ける
+			break
+		}
+	}
+	result.Done = err == nil && result.Index >= len(allKinds)
+	audit(c, "banplayer", "", name, fmt.Sprintf("%s, %d件", ban.Reason, result.Hidden))
+	
+	writeJSON(c, w, result)
+}
+
+/**
+ * プレイヤーの出場停止を解除する
+ * 取り除いていたエンティティは元のランキングに戻す
+ * 一度に banBatchSize 件ずつ戻すので、Done が true になるまで繰り返し呼び出す（すべて戻したら出場停止を解除する）
+ * 管理者のみ実行できる
+ * /unbanplayer?name=xxxxxx
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func unbanPlayer(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var name string
+	var banKey *datastore.Key
+	var hiddenKeys []*datastore.Key
+	var hiddens []*Hidden
+	var keys []*datastore.Key
+	var entities []*Entity
+	var result *UnbanResult
+	var i int
+	var err error
+	
+	c = appengine.NewContext(r)
+	if !requireAdmin(c, w, r) {
+		return
+	}
+	name = r.FormValue("name")
+	if name == "" {
+		writeError(c, w, http.StatusBadRequest, "name が指定されていません")
+		return
+	}
+	
+	banKey = datastore.NewKey(c, "Ban", name, 0, nil)
+	hiddenKeys, err = datastore.NewQuery("Hidden").Ancestor(banKey).Limit(banBatchSize).GetAll(c, &hiddens)
+	check(c, err)
+	if err != nil {
+		writeError(c, w, http.StatusInternalServerError, "取り除いたエンティティを読み込めませんでした")
+		return
+	}
+	
+	keys = make([]*datastore.Key, len(hiddens))
+	entities = make([]*Entity, len(hiddens))
+	for i = 0; i < len(hiddens); i++ {
+		keys[i] = hiddens[i].Key
+		entities[i] = &hiddens[i].Entry
+	}
+	if len(keys) > 0 {
+		_, err = datastore.PutMulti(c, keys, entities)
+		check(c, err)
+		if err != nil {
+			writeError(c, w, http.StatusInternalServerError, "エンティティを戻せませんでした")
+			return
+		}
+		err = datastore.DeleteMulti(c, hiddenKeys)
+		check(c, err)
+		if err != nil {
+			writeError(c, w, http.StatusInternalServerError, "エンティティを戻せませんでした")
+			return
+		}
+	}
+	
+	// 戻したエンティティを kind ごとに統計に加える
+	var restored map[string][]*Entity
+	var kind string
+	var board *Board
+	restored = make(map[string][]*Entity)
+	for i = 0; i < len(keys); i++ {
+		restored[keys[i].Kind()] = append(restored[keys[i].Kind()], entities[i])
+	}
+	for kind = range restored {
+		invalidateTop(c, kind)
+		board, err = loadBoard(c, strings.SplitN(kind, "@", 2)[0])
+		check(c, err)
+		if err == nil {
+			check(c, board.updateStats(c, kind, restored[kind], nil))
+		}
+	}
+	
+	result = new(UnbanResult)
+	result.Restored = len(keys)
+	result.Done = len(keys) < banBatchSize
+	if result.Done {
+		err = datastore.Delete(c, banKey)
+		check(c, err)
+	}
+	audit(c, "unbanplayer", "", name, fmt.Sprintf("%d件", len(keys)))
+	
+	writeJSON(c, w, result)
+}
+
+/**
+ * ランキングのデータを削除する
+ * archive を指定すると、削除する前に通常のランキングを kind@archive:名前 にコピーする
+ * アーカイブは getRanking の archive で参照できる
+ * 期間別ランキングも削除するが、シーズンと過去のアーカイブは残す
+ * すべて削除し終えたら、削除した kind の得点の統計も削除する
+ * 一度に wipeBatchSize 件ずつ削除するので、Done が true になるまで繰り返し呼び出す
+ * 管理者のみ実行できる
+ * /wipeboard?kind=xxxxxx&archive=xxxxxx
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func wipeBoard(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var board *Board
+	var archive string
+	var kinds []string
+	var result *WipeResult
+	var i, j int
+	var err error
+	
+	c = appengine.NewContext(r)
+	if !requireAdmin(c, w, r) {
+		return
+	}
+	board = requestBoard(c, w, r)
+	if board == nil {
+		return
+	}
+	archive = r.FormValue("archive")
+	if strings.Contains(archive, "@") {
+		writeError(c, w, http.StatusBadRequest, "archive に @ は使えません")
+		return
+	}
+	
+	kinds, err = board.kinds(c)
+	check(c, err)
+	
+	result = new(WipeResult)
+	for i = 0; i < len(kinds) && result.Deleted < wipeBatchSize; i++ {
+		if strings.Contains(kinds[i], "@season:") || strings.Contains(kinds[i], "@archive:") {
+			continue
+		}
+		
+		var keys []*datastore.Key
+		var entities []*Entity
+		var query *datastore.Query
+		query = datastore.NewQuery(kinds[i]).Limit(wipeBatchSize - result.Deleted)
+		if archive != "" && kinds[i] == board.ID {
+			keys, err = query.GetAll(c, &entities)
+			check(c, err)
+			var archiveKeys []*datastore.Key
+			archiveKeys = make([]*datastore.Key, len(keys))
+			for j = 0; j < len(keys); j++ {
+				archiveKeys[j] = datastore.NewKey(c, archiveKind(board.ID, archive), keys[j].StringID(), keys[j].IntID(), nil)
+			}
+			_, err = datastore.PutMulti(c, archiveKeys, entities)
+			check(c, err)
+			if err != nil {
+				break
+			}
+			result.Archived += len(keys)
+			invalidateTop(c, archiveKind(board.ID, archive))
+		} else {
+			keys, err = query.KeysOnly().GetAll(c, nil)
+			check(c, err)
+		}
+		
+		err = datastore.DeleteMulti(c, keys)
+		check(c, err)
+		if err != nil {
+			break
+		}
+		result.Deleted += len(keys)
+		invalidateTop(c, kinds[i])
+	}
+	result.Done = err == nil && result.Deleted < wipeBatchSize
+	if result.Done {
+		err = board.wipeStats(c)
+		check(c, err)
+	}
+	audit(c, "wipeboard", board.ID, archive, fmt.Sprintf("%d件削除, %d件アーカイブ", result.Deleted, result.Archived))
+	
+	writeJSON(c, w, result)
+}
+
+/**
+ * アーカイブを保存する kind 名を返す
+ * 例: score@archive:2013spring
+ * @function
+ * @param {string} kind ランキングの種類
+ * @param {string} name アーカイブ名
+ * @returns {string} kind 名
+ */
+func archiveKind(kind string, name string) string {
+	return strings.Join([]string{kind, "@archive:", name}, "")
+}
@@ -0,0 +1,391 @@
+package okanoworld
+
+import(
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"appengine"
+	"appengine/datastore"
+)
+
+/**
+ * rebuildAggregate で一度に集計し直すエンティティの件数
+ * 1人ごとに集計元をすべて読むので少なめにする
+ */
+const aggregateBatchSize = 50
+
+/**
+ * rebuildAggregate の応答
+ * @member {int} Refreshed 集計し直したエンティティの件数
+ * @member {int} Index 次に呼び出すときに指定する番号（0 は集計ランキング自身、1 以降は Sources の順）
+ * @member {string} Cursor 次に呼び出すときに指定するカーソル
+ * @member {bool} Done すべて集計し終わったかどうか
+ */
+type AggregateResult struct {
+	Refreshed int
+	Index int
+	Cursor string
+	Done bool
+}
+
+/**
+ * 集計ランキングの集計方法
+ * sum は各ランキングの自己ベストの合計、best は各ランキングの自己ベストのうち最も良いもの
+ */
+var aggregations = []string{"sum", "best"}
+
+/**
+ * 集計ランキングかどうか
+ * @method
+ * @memberof Board
+ * @returns {bool} 他のランキングから集計するなら true
+ */
+func (this *Board) isAggregate() bool {
+	return len(this.Sources) > 0
+}
+
+/**
+ * 集計ランキングの設定を検査する
+ * 集計元は登録済みの通常のランキングでなければならない
+ * 集計ランキングは他の集計ランキングの集計元にできない
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @returns {error} 正しくなければエラー
+ */
+func (this *Board) validateSources(c appengine.Context) error {
+	var boards []*Board
+	var found bool
+	var i, j int
+	var err error
+	
+	boards, err = loadBoards(c)
+	if err != nil {
+		return err
+	}
+	for i = 0; i < len(boards); i++ {
+		if boards[i].ID == this.ID || !boards[i].isAggregate() {
+			continue
+		}
+		for j = 0; j < len(boards[i].Sources); j++ {
+			if boards[i].Sources[j] == this.ID && this.isAggregate() {
+				return errors.New("集計元になっているランキングは集計ランキングにできません: " + boards[i].ID)
+			}
+		}
+	}
+	if !this.isAggregate() {
+		return nil
+	}
+	
+	if len(this.Periods) > 0 {
+		return errors.New("集計ランキングでは期間別ランキングを集計できません")
+	}
+	found = false
+	for i = 0; i < len(aggregations); i++ {
+		if this.Aggregate == aggregations[i] {
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("aggregate は sum か best で指定してください")
+	}
+	for i = 0; i < len(this.Sources); i++ {
+		if this.Sources[i] == this.ID {
+			return errors.New("自分自身を集計元にはできません")
+		}
+		found = false
+		for j = 0; j < len(boards); j++ {
+			if boards[j].ID != this.Sources[i] {
+				continue
+			}
+			if boards[j].isAggregate() {
+				return errors.New("集計ランキングは集計元にできません: " + this.Sources[i])
+			}
+			found = true
+		}
+		if !found {
+			return errors.New("集計元のランキングが登録されていません: " + this.Sources[i])
+		}
+	}
+	return nil
+}
+
+/**
+ * 集計元の指定を解析する
+ * @function
+ * @param {string} str カンマ区切りの kind 名
+ * @returns {[]string} 集計元の kind 名のリスト
+ */
+func parseSources(str string) []string {
+	if str == "" {
+		return []string{}
+	}
+	return strings.Split(str, ",")
+}
+
+/**
+ * このランキングを集計元にしている集計ランキングを返す
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @returns {[]*Board} 集計ランキングのリスト
+ * @returns {error} エラー
+ */
+func (this *Board) aggregates(c appengine.Context) ([]*Board, error) {
+	var boards []*Board
+	var result []*Board
+	var i, j int
+	var err error
+	
+	boards, err = loadBoards(c)
+	if err != nil {
+		return nil, err
+	}
+	result = make([]*Board, 0)
+	for i = 0; i < len(boards); i++ {
+		for j = 0; j < len(boards[i].Sources); j++ {
+			if boards[i].Sources[j] == this.ID {
+				result = append(result, boards[i])
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+/**
+ * このランキングを集計元にしている集計ランキングでプレイヤーの成績を集計し直す
+ * 集計元のランキングに書き込んだときや、集計元からエンティティを削除したときに呼び出す
+ * 自己ベストだけを保持しないランキングでは名前のクエリに書き込んだ直後のデータが含まれないことがあるので、書き込んだデータを written で渡す
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} name プレイヤー名
+ * @param {*Entity} written このランキングに書き込んだデータ（削除したときは nil）
+ * @returns {error} エラー
+ */
+func (this *Board) refreshAggregates(c appengine.Context, name string, written *Entity) error {
+	var boards []*Board
+	var i int
+	var err error
+	
+	if name == "" {
+		return nil
+	}
+	boards, err = this.aggregates(c)
+	if err != nil {
+		return err
+	}
+	for i = 0; i < len(boards); i++ {
+		err = boards[i].aggregatePlayer(c, name, this.ID, written)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * 集計元のランキングからプレイヤーの自己ベストを集めて、集計ランキングのエンティティを書き直す
+ * どの集計元にもエンティティがなければ集計ランキングからも削除する
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} name プレイヤー名
+ * @param {string} sourceID written を書き込んだ集計元の kind 名
+ * @param {*Entity} written 集計元に書き込んだデータ（クエリの結果に含まれていなくても集計に加える、なければ nil）
+ * @returns {error} エラー
+ */
+func (this *Board) aggregatePlayer(c appengine.Context, name string, sourceID string, written *Entity) error {
+	var source *Board
+	var entry *Entity
+	var entity *Entity
+	var key *datastore.Key
+	var count int
+	var i int
+	var err error
+	
+	entity = new(Entity)
+	entity.Name = name
+	for i = 0; i < len(this.Sources); i++ {
+		source, err = loadBoard(c, this.Sources[i])
+		if err == errUnknownBoard {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_, entry, err = findEntry(c, source, source.ID, "", name)
+		if err == datastore.ErrNoSuchEntity {
+			entry = nil
+		} else if err != nil {
+			return err
+		}
+		if written != nil && source.ID == sourceID && (entry == nil || source.better(written, entry)) {
+			entry = written
+		}
+		if entry == nil {
+			continue
+		}
+		
+		switch this.Aggregate {
+		case "sum":
+			entity.Score += entry.Score
+		case "best":
+			if count == 0 || this.better(entry, entity) {
+				entity.Score = entry.Score
+			}
+		}
+		if entry.Created.After(entity.Created) {
+			entity.Created = entry.Created
+		}
+		// プレイヤーとして送信していれば表示名に置き換えられるようにする
+		if entry.Player != "" {
+			entity.Player = entry.Player
+		}
+		count++
+	}
+	
+	key = datastore.NewKey(c, this.ID, name, 0, nil)
+	var stored *Entity
+	stored = new(Entity)
+	err = datastore.Get(c, key, stored)
+	if err == datastore.ErrNoSuchEntity {
+		stored = nil
+	} else if err != nil {
+		return err
+	}
+	
+	if count == 0 {
+		if stored == nil {
+			return nil
+		}
+		err = datastore.Delete(c, key)
+		if err != nil {
+			return err
+		}
+		invalidateTop(c, this.ID)
+		return this.updateStats(c, this.ID, nil, []*Entity{stored})
+	}
+	if stored != nil && stored.Score == entity.Score && stored.Player == entity.Player {
+		return nil
+	}
+	
+	entity.SortKey = this.sortKey(entity)
+	_, err = datastore.Put(c, key, entity)
+	if err != nil {
+		return err
+	}
+	this.patchTop(c, this.ID, key, entity, stored != nil)
+	if stored != nil {
+		return this.updateStats(c, this.ID, []*Entity{entity}, []*Entity{stored})
+	}
+	return this.updateStats(c, this.ID, []*Entity{entity}, nil)
+}
+
+/**
+ * 集計ランキングを集計元から集計し直す
+ * 集計ランキングを作ったときや集計元を変えたときに、まだ送信していないプレイヤーの成績を反映する
+ * まず集計ランキングに残っているプレイヤーを（集計元から外れていれば削除して）集計し直し、次に集計元のランキングのプレイヤーを順に集計する
+ * 一度に aggregateBatchSize 件ずつ集計するので、Done が true になるまで Index と Cursor を渡して繰り返し呼び出す
+ * 管理者のみ実行できる
+ * /rebuildaggregate?kind=xxxxxx&index=0&cursor=xxxxxx
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func rebuildAggregate(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var board *Board
+	var kind string
+	var result *AggregateResult
+	var query *datastore.Query
+	var iterator *datastore.Iterator
+	var cursor datastore.Cursor
+	var names map[string]bool
+	var entity *Entity
+	var count int
+	var err error
+	
+	c = appengine.NewContext(r)
+	if !requireAdmin(c, w, r) {
+		return
+	}
+	board = requestBoard(c, w, r)
+	if board == nil {
+		return
+	}
+	if !board.isAggregate() {
+		writeError(c, w, http.StatusBadRequest, "集計ランキングではありません")
+		return
+	}
+	
+	result = new(AggregateResult)
+	if r.FormValue("index") != "" {
+		result.Index, err = strconv.Atoi(r.FormValue("index"))
+		if err != nil || result.Index < 0 {
+			writeError(c, w, http.StatusBadRequest, "index が正しくありません")
+			return
+		}
+	}
+	if result.Index > len(board.Sources) {
+		result.Done = true
+		writeJSON(c, w, result)
+		return
+	}
+	kind = board.ID
+	if result.Index > 0 {
+		kind = board.Sources[result.Index - 1]
+	}
+	
+	query = datastore.NewQuery(kind).Limit(aggregateBatchSize)
+	if r.FormValue("cursor") != "" {
+		cursor, err = datastore.DecodeCursor(r.FormValue("cursor"))
+		if err != nil {
+			writeError(c, w, http.StatusBadRequest, "cursor が正しくありません")
+			return
+		}
+		query = query.Start(cursor)
+	}
+	
+	names = make(map[string]bool)
+	iterator = query.Run(c)
+	for {
+		entity = new(Entity)
+		_, err = iterator.Next(entity)
+		if err == datastore.Done {
+			break
+		}
+		check(c, err)
+		if err != nil {
+			writeError(c, w, http.StatusInternalServerError, "エンティティを読み込めませんでした")
+			return
+		}
+		count++
+		if names[entity.Name] {
+			continue
+		}
+		names[entity.Name] = true
+		err = board.aggregatePlayer(c, entity.Name, "", nil)
+		check(c, err)
+		if err != nil {
+			writeError(c, w, http.StatusInternalServerError, "集計できませんでした")
+			return
+		}
+		result.Refreshed++
+	}
+	
+	if count < aggregateBatchSize {
+		result.Index++
+		result.Done = result.Index > len(board.Sources)
+	} else {
+		cursor, err = iterator.Cursor()
+		check(c, err)
+		result.Cursor = cursor.String()
+	}
+	audit(c, "rebuildaggregate", board.ID, kind, fmt.Sprintf("%d件", result.Refreshed))
+	
+	writeJSON(c, w, result)
+}
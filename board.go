@@ -0,0 +1,425 @@
+package okanoworld
+
+import(
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"appengine"
+	"appengine/datastore"
+)
+
+/**
+ * ランキングの設定
+ * 登録されたランキングにだけ getRanking や putRanking でアクセスできる
+ * datastore には kind "Board"、キー名をランキングの kind 名として保存する
+ * @class
+ * @member {string} ID ランキングの kind 名（キー名から復元する）
+ * @member {string} Name 表示名
+ * @member {bool} BestOnly true ならプレイヤーごとに最高得点だけを保持する
+ * @member {[]string} Periods 集計する期間別ランキング（day, week, month）
+ * @member {string} TimeZone 期間の区切りに使う時差（省略時は Asia/Tokyo）
+ * @member {bool} Ascending true なら得点の低い順に並べる（タイムアタックなど）
+ * @member {int} MinScore 受け付ける最低得点
+ * @member {int} MaxScore 受け付ける最高得点（MinScore 以下なら得点の範囲を制限しない）
+ * @member {int} KeepTop 保持する上位件数（0なら無制限）
+ * @member {int} RetentionDays 上位 KeepTop 件以外のデータを保持する日数（0なら無期限）
+ * @member {string} Secret 送信の署名に使う秘密鍵（空文字列なら署名なしで受け付ける）
+ * @member {int} MaxGainPerMinute 自己ベストからの1分あたりの伸びの上限（0なら制限しない）
+ * @member {int} NameMinLength プレイヤー名の最小文字数
+ * @member {int} NameMaxLength プレイヤー名の最大文字数（0なら制限しない）
+ * @member {string} NamePattern プレイヤー名に使える文字を表す正規表現（空文字列なら制限しない）
+ * @member {float64} OutlierFactor 現在の1位の何倍を超えたら承認待ちにするか（0なら判定しない）
+ * @member {float64} PlayerOutlierFactor 自己ベストの何倍を超えたら承認待ちにするか（0なら判定しない）
+ * @member {[]string} Fields putRanking で受け付ける追加項目の宣言（"名前:型:最大長"）
+ * @member {int} MaxReplayBytes 受け付けるリプレイの最大サイズ（0ならリプレイを受け付けない）
+ * @member {int} ReplayTopN リプレイを残す上位件数（0なら100件）
+ * @member {[]string} Criteria 得点が同じときに順位を決める基準の宣言（"名前:並び順"、宣言した順に比べる）
+ * @member {int} StatsBucketSize 得点の統計の度数分布の区間の幅（0なら得点の範囲から決める）
+ * @member {[]string} Sources 集計ランキングの集計元の kind 名（空なら通常のランキング）
+ * @member {string} Aggregate 集計ランキングの集計方法（sum, best）
+ * @member {[]string} Partitions 区分別ランキングを作る区分の宣言（"名前=値|値|..."、Partition を参照）
+ * @member {int} SnapshotTopN 順位のスナップショットを取る上位件数（0なら100件）
+ */
+type Board struct {
+	ID string `datastore:"-"`
+	Name string
+	BestOnly bool
+	Periods []string
+	TimeZone string
+	Ascending bool
+	MinScore int
+	MaxScore int
+	KeepTop int
+	RetentionDays int
+	Secret string `json:"-"`
+	MaxGainPerMinute int
+	NameMinLength int
+	NameMaxLength int
+	NamePattern string
+	OutlierFactor float64
+	PlayerOutlierFactor float64
+	Fields []string
+	MaxReplayBytes int
+	ReplayTopN int
+	Criteria []string
+	StatsBucketSize int
+	Sources []string
+	Aggregate string
+	Partitions []string
+	SnapshotTopN int
+}
+
+/**
+ * ランキングとして使えない kind 名
+ * サーバが内部で使っている kind と重ならないようにする
+ */
+var reservedKinds = []string{"Board", "Season", "Standing", "Nonce", "Rejection", "Pending", "Ban", "Hidden", "Audit", "Replay", "Stats", "FriendList", "Player", "Snapshot"}
+
+/**
+ * 登録されていないランキングを指定したときのエラー
+ */
+var errUnknownBoard = errors.New("登録されていないランキングです")
+
+/**
+ * ランキングの設定のキーを返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} kind ランキングの種類
+ * @returns {*datastore.Key} 設定のキー
+ */
+func boardKey(c appengine.Context, kind string) *datastore.Key {
+	return datastore.NewKey(c, "Board", kind, 0, nil)
+}
+
+/**
+ * ランキングの設定を取得する
+ * 登録されていなければ errUnknownBoard を返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} kind ランキングの種類
+ * @returns {*Board} ランキングの設定
+ * @returns {error} エラー
+ */
+func loadBoard(c appengine.Context, kind string) (*Board, error) {
+	var board *Board
+	var err error
+	
+	if kind == "" {
+		return nil, errUnknownBoard
+	}
+	
+	board = new(Board)
+	err = datastore.Get(c, boardKey(c, kind), board)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, errUnknownBoard
+	}
+	if err != nil {
+		return nil, err
+	}
+	board.ID = kind
+	
+	return board, nil
+}
+
+/**
+ * リクエストの kind で指定されたランキングの設定を取得する
+ * 取得できなければエラーを応答して nil を返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @returns {*Board} ランキングの設定
+ */
+func requestBoard(c appengine.Context, w http.ResponseWriter, r *http.Request) *Board {
+	var board *Board
+	var err error
+	
+	board, err = loadBoard(c, r.FormValue("kind"))
+	if err == errUnknownBoard {
+		writeError(c, w, http.StatusNotFound, strings.Join([]string{err.Error(), ": ", r.FormValue("kind")}, ""))
+		return nil
+	}
+	check(c, err)
+	if err != nil {
+		writeError(c, w, http.StatusInternalServerError, "ランキングの設定を読み込めませんでした")
+		return nil
+	}
+	return board
+}
+
+/**
+ * ランキングの kind 名として使えるかどうかを確認する
+ * 期間別ランキングやシーズンの kind 名と区別するため @ は使えない
+ * @function
+ * @param {string} kind ランキングの種類
+ * @returns {error} 使えない場合はエラー
+ */
+func validateKind(kind string) error {
+	var i int
+	
+	if kind == "" {
+		return errors.New("kind が指定されていません")
+	}
+	if strings.Contains(kind, "@") || strings.HasPrefix(kind, "__") {
+		return errors.New("kind に @ を含めたり __ で始めたりすることはできません")
+	}
+	for i = 0; i < len(reservedKinds); i++ {
+		if kind == reservedKinds[i] {
+			return errors.New("kind に " + kind + " は使えません")
+		}
+	}
+	return nil
+}
+
+/**
+ * ランキングを登録する
+ * 同じ kind のランキングがあれば設定を上書きする
+ * 管理者のみ実行できる
+ * /putboard?kind=xxxxxx&name=xxxxxx&best=1&periods=day,week,month&tz=Asia/Tokyo&order=asc&min=0&max=999999&keep=100&retention=30&secret=xxxxxx
+ * プレイヤー名と得点の検査ルールは namemin, namemax, namepattern, maxgain で指定する
+ * 承認待ちにする外れ値の倍率は outlier, playeroutlier で指定する
+ * 追加項目は fields=stage:int,character:string:16,time:float のように指定する
+ * リプレイの最大サイズと残す上位件数は replaymax, replaytop で指定する
+ * 得点が同じときに順位を決める基準は criteria=time:asc,combo:desc のように指定する
+ * 並び順の設定（order, criteria）を変えたときは resortBoard を実行する
+ * 得点の統計の区間の幅は statsbucket で指定する（変えたときは rebuildStats を実行する）
+ * 集計ランキングは sources=stage1,stage2&aggregate=sum のように指定する（作成したときや集計元を変えたときは rebuildAggregate で集計し直す）
+ * 集計ランキングはプレイヤーごとに1件だけ保持し、集計元のランキングに書き込まれたときに更新する
+ * 区分別ランキングは partitions=region=JP|US|EU,platform=ios|android のように区分の名前と値を指定する
+ * 順位のスナップショットを取る上位件数は snapshottop で指定する
+ * keep と retention で保持する件数と期間を指定すると、pruneBoards で古いデータを削除する
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func putBoard(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var kind string
+	var board *Board
+	var key *datastore.Key
+	var err error
+	
+	c = appengine.NewContext(r)
+	if !requireAdmin(c, w, r) {
+		return
+	}
+	
+	kind = r.FormValue("kind")
+	err = validateKind(kind)
+	if err != nil {
+		writeError(c, w, http.StatusBadRequest, err.Error())
+		return
+	}
+	
+	board = new(Board)
+	board.ID = kind
+	board.Name = r.FormValue("name")
+	if board.Name == "" {
+		board.Name = kind
+	}
+	board.BestOnly = r.FormValue("best") == "1"
+	board.Periods, err = parsePeriods(r.FormValue("periods"))
+	if err != nil {
+		writeError(c, w, http.StatusBadRequest, err.Error())
+		return
+	}
+	board.Ascending = r.FormValue("order") == "asc"
+	board.Secret = r.FormValue("secret")
+	board.TimeZone = r.FormValue("tz")
+	if board.TimeZone != "" {
+		_, err = time.LoadLocation(board.TimeZone)
+		if err != nil {
+			writeError(c, w, http.StatusBadRequest, "tz が正しくありません")
+			return
+		}
+	}
+	
+	var numbers = map[string]*int{
+		"min": &board.MinScore,
+		"max": &board.MaxScore,
+		"keep": &board.KeepTop,
+		"retention": &board.RetentionDays,
+		"maxgain": &board.MaxGainPerMinute,
+		"namemin": &board.NameMinLength,
+		"namemax": &board.NameMaxLength,
+		"replaymax": &board.MaxReplayBytes,
+		"replaytop": &board.ReplayTopN,
+		"statsbucket": &board.StatsBucketSize,
+		"snapshottop": &board.SnapshotTopN,
+	}
+	var name string
+	var number *int
+	for name, number = range numbers {
+		if r.FormValue(name) == "" {
+			continue
+		}
+		*number, err = strconv.Atoi(r.FormValue(name))
+		if err != nil {
+			writeError(c, w, http.StatusBadRequest, name + " が正しくありません")
+			return
+		}
+	}
+	if board.KeepTop < 0 || board.RetentionDays < 0 {
+		writeError(c, w, http.StatusBadRequest, "keep と retention は0以上で指定してください")
+		return
+	}
+	if board.MaxReplayBytes < 0 || board.MaxReplayBytes > maxReplayLimit || board.ReplayTopN < 0 {
+		writeError(c, w, http.StatusBadRequest, "replaymax と replaytop が正しくありません")
+		return
+	}
+	if board.StatsBucketSize < 0 || board.SnapshotTopN < 0 {
+		writeError(c, w, http.StatusBadRequest, "statsbucket と snapshottop は0以上で指定してください")
+		return
+	}
+	var factors = map[string]*float64{
+		"outlier": &board.OutlierFactor,
+		"playeroutlier": &board.PlayerOutlierFactor,
+	}
+	var factor *float64
+	for name, factor = range factors {
+		if r.FormValue(name) == "" {
+			continue
+		}
+		*factor, err = strconv.ParseFloat(r.FormValue(name), 64)
+		if err != nil || *factor < 0 || (*factor > 0 && *factor < 1) {
+			writeError(c, w, http.StatusBadRequest, name + " は1以上で指定してください")
+			return
+		}
+	}
+	board.Fields, err = parseFields(r.FormValue("fields"))
+	if err != nil {
+		writeError(c, w, http.StatusBadRequest, err.Error())
+		return
+	}
+	board.Criteria, err = parseCriteria(r.FormValue("criteria"))
+	if err != nil {
+		writeError(c, w, http.StatusBadRequest, err.Error())
+		return
+	}
+	board.Partitions, err = parsePartitions(r.FormValue("partitions"))
+	if err != nil {
+		writeError(c, w, http.StatusBadRequest, err.Error())
+		return
+	}
+	board.Sources = parseSources(r.FormValue("sources"))
+	board.Aggregate = r.FormValue("aggregate")
+	if board.isAggregate() {
+		board.BestOnly = true
+	}
+	err = board.validateSources(c)
+	if err != nil {
+		writeError(c, w, http.StatusBadRequest, err.Error())
+		return
+	}
+	board.NamePattern = r.FormValue("namepattern")
+	_, err = regexp.Compile(board.NamePattern)
+	if err != nil {
+		writeError(c, w, http.StatusBadRequest, "namepattern が正しくありません")
+		return
+	}
+	
+	key = boardKey(c, kind)
+	_, err = datastore.Put(c, key, board)
+	check(c, err)
+	// 並び順が変わるかもしれないのでキャッシュを捨てる
+	check(c, board.invalidateTops(c))
+	var detail []byte
+	detail, err = json.Marshal(board)
+	check(c, err)
+	audit(c, "putboard", kind, "", string(detail))
+	
+	writeJSON(c, w, board)
+}
+
+/**
+ * 登録されているランキングの一覧を取得する
+ * /getboards
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func getBoards(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var boards []*Board
+	var err error
+	
+	c = appengine.NewContext(r)
+	
+	boards, err = loadBoards(c)
+	check(c, err)
+	
+	writeJSON(c, w, boards)
+}
+
+/**
+ * 得点が受け付ける範囲に入っているかどうか
+ * @method
+ * @memberof Board
+ * @param {int} score 得点
+ * @returns {bool} 範囲内なら true
+ */
+func (this *Board) inRange(score int) bool {
+	if this.MaxScore <= this.MinScore {
+		return true
+	}
+	return this.MinScore <= score && score <= this.MaxScore
+}
+
+/**
+ * ランキングのデータを保存している kind 名をすべて返す
+ * 通常のランキングに加えて、期間別ランキング、シーズン、アーカイブの kind 名が含まれる
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @returns {[]string} kind 名のリスト
+ * @returns {error} エラー
+ */
+func (this *Board) kinds(c appengine.Context) ([]string, error) {
+	var keys []*datastore.Key
+	var kinds []string
+	var query *datastore.Query
+	var i int
+	var err error
+	
+	// "@" の次の文字は "A" なので、この範囲に "ID@..." の kind 名がすべて含まれる
+	query = datastore.NewQuery("__kind__").
+		Filter("__key__ >", datastore.NewKey(c, "__kind__", this.ID + "@", 0, nil)).
+		Filter("__key__ <", datastore.NewKey(c, "__kind__", this.ID + "A", 0, nil)).
+		KeysOnly()
+	keys, err = query.GetAll(c, nil)
+	if err != nil {
+		return nil, err
+	}
+	
+	kinds = make([]string, 0, len(keys) + 1)
+	kinds = append(kinds, this.ID)
+	for i = 0; i < len(keys); i++ {
+		kinds = append(kinds, keys[i].StringID())
+	}
+	return kinds, nil
+}
+
+/**
+ * 登録されているランキングの設定をすべて取得する
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @returns {[]*Board} ランキングの設定のリスト
+ * @returns {error} エラー
+ */
+func loadBoards(c appengine.Context) ([]*Board, error) {
+	var keys []*datastore.Key
+	var boards []*Board
+	var i int
+	var err error
+	
+	boards = make([]*Board, 0)
+	keys, err = datastore.NewQuery("Board").GetAll(c, &boards)
+	for i = 0; i < len(keys) && i < len(boards); i++ {
+		boards[i].ID = keys[i].StringID()
+	}
+	return boards, err
+}
@@ -0,0 +1,479 @@
+package okanoworld
+
+import(
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+)
+
+/**
+ * キャッシュする上位の件数
+ */
+const topCacheSize = 100
+
+/**
+ * インスタンスのメモリに置いたキャッシュを使う時間
+ * 他のインスタンスで登録された得点は、この時間が過ぎて memcache から読み直すまで反映されない
+ */
+const topLocalTTL = 10 * time.Second
+
+/**
+ * memcache に置いたキャッシュの有効期限
+ * 読み込みと更新が同時に起きて古い内容が残っても、この時間で消える
+ */
+const topMemcacheExpiration = time.Minute
+
+/**
+ * patchTop がキャッシュを見つけられなかったときに、loadTop がキャッシュを作らない時間
+ * 登録した直後は datastore のクエリに反映されていないことがあるので、その間に読み込んだ内容はキャッシュしない
+ */
+const topDirtyExpiration = 5 * time.Second
+
+/**
+ * 書き換えが競合したときにやり直す回数
+ */
+const topPatchAttempts = 3
+
+/**
+ * インスタンスのメモリに置いたキャッシュ（kind 名ごと）
+ */
+var topCaches = make(map[string]*TopCache)
+
+/**
+ * topCaches の排他制御
+ */
+var topCachesLock sync.Mutex
+
+/**
+ * このインスタンスでキャッシュを使えた回数
+ */
+var topHits int64
+
+/**
+ * このインスタンスでキャッシュがなく datastore から読み込んだ回数
+ */
+var topMisses int64
+
+/**
+ * ランキングの上位 topCacheSize 件のキャッシュ
+ * getRanking のたびに Count と並び順のクエリを実行しなくて済むように、インスタンスのメモリと memcache に置く
+ * putRanking で登録した得点はキャッシュを書き換えて反映し、削除や並べ替えではキャッシュを捨てる
+ * Entities の件数は常に Total と topCacheSize の小さい方に等しい（そうでなくなったら捨てる）
+ * 前回のスナップショットの順位とプレイヤーの表示名も一緒に置き、キャッシュから応答するときは datastore を読まない
+ * 表示名の変更はキャッシュを読み込み直すまで反映されない
+ * @class
+ * @member {[]string} Keys エンティティのキー
+ * @member {[]*Entity} Entities 並び順に並んだランキングデータ
+ * @member {int} Total ランキングの登録件数
+ * @member {map[string]int} PreviousRanks 最新のスナップショットのプレイヤー名から順位への対応（スナップショットがなければ nil）
+ * @member {map[string]string} DisplayNames Entities のプレイヤーIDから表示名への対応（後から加えたデータのプレイヤーは入っていないことがある）
+ * @member {time.Time} Loaded このインスタンスで読み込んだ日時
+ */
+type TopCache struct {
+	Keys []string
+	Entities []*Entity
+	Total int
+	PreviousRanks map[string]int
+	DisplayNames map[string]string
+	Loaded time.Time
+}
+
+/**
+ * getCacheStats の応答
+ * @member {int64} Hits このインスタンスでキャッシュを使えた回数
+ * @member {int64} Misses このインスタンスで datastore から読み込んだ回数
+ * @member {int} Kinds このインスタンスのメモリにキャッシュしている kind の数
+ * @member {*memcache.Statistics} Memcache memcache 全体の統計
+ */
+type CacheStats struct {
+	Hits int64
+	Misses int64
+	Kinds int
+	Memcache *memcache.Statistics `json:",omitempty"`
+}
+
+/**
+ * memcache のキーを返す
+ * @function
+ * @param {string} kind kind 名
+ * @returns {string} memcache のキー
+ */
+func topCacheKey(kind string) string {
+	return "top:" + kind
+}
+
+/**
+ * キャッシュを作らないようにする印の memcache のキーを返す
+ * @function
+ * @param {string} kind kind 名
+ * @returns {string} memcache のキー
+ */
+func topDirtyKey(kind string) string {
+	return "topdirty:" + kind
+}
+
+/**
+ * インスタンスのメモリにキャッシュを置く
+ * @function
+ * @param {string} kind kind 名
+ * @param {*TopCache} top キャッシュ（nil なら取り除く）
+ */
+func setLocalTop(kind string, top *TopCache) {
+	topCachesLock.Lock()
+	defer topCachesLock.Unlock()
+	if top == nil {
+		delete(topCaches, kind)
+		return
+	}
+	top.Loaded = time.Now()
+	topCaches[kind] = top
+}
+
+/**
+ * インスタンスのメモリに置いたキャッシュを返す
+ * @function
+ * @param {string} kind kind 名
+ * @returns {*TopCache} キャッシュ（ないか古ければ nil）
+ */
+func localTop(kind string) *TopCache {
+	var top *TopCache
+	topCachesLock.Lock()
+	defer topCachesLock.Unlock()
+	top = topCaches[kind]
+	if top == nil || time.Since(top.Loaded) > topLocalTTL {
+		return nil
+	}
+	return top
+}
+
+/**
+ * ランキングの上位のキャッシュを返す
+ * インスタンスのメモリ、memcache の順に探し、どちらにもなければ datastore から読み込んでキャッシュする
+ * patchTop が印を付けている間は、読み込んだ内容に直前の登録が含まれていないかもしれないのでキャッシュしない
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} kind kind 名
+ * @returns {*TopCache} キャッシュ（書き換えないこと）
+ * @returns {error} エラー
+ */
+func (this *Board) loadTop(c appengine.Context, kind string) (*TopCache, error) {
+	var top *TopCache
+	var keys []*datastore.Key
+	var i int
+	var err error
+	
+	top = localTop(kind)
+	if top != nil {
+		atomic.AddInt64(&topHits, 1)
+		return top, nil
+	}
+	top = new(TopCache)
+	_, err = memcache.Gob.Get(c, topCacheKey(kind), top)
+	if err == nil {
+		atomic.AddInt64(&topHits, 1)
+		setLocalTop(kind, top)
+		return top, nil
+	}
+	if err != memcache.ErrCacheMiss {
+		check(c, err)
+	}
+	
+	atomic.AddInt64(&topMisses, 1)
+	top = new(TopCache)
+	keys, err = datastore.NewQuery(kind).Order(sortOrder).Limit(topCacheSize).GetAll(c, &top.Entities)
+	if err != nil {
+		return nil, err
+	}
+	top.Total, err = datastore.NewQuery(kind).KeysOnly().Count(c)
+	if err != nil {
+		return nil, err
+	}
+	top.Keys = make([]string, len(keys))
+	for i = 0; i < len(keys); i++ {
+		top.Keys[i] = keys[i].Encode()
+		top.Entities[i].SortKey = this.sortKey(top.Entities[i])
+	}
+	top.PreviousRanks, err = this.previousRanks(c, kind)
+	if err != nil {
+		return nil, err
+	}
+	top.DisplayNames = loadDisplayNames(c, top.Entities)
+	_, err = memcache.Get(c, topDirtyKey(kind))
+	if err == nil {
+		return top, nil
+	}
+	if err != memcache.ErrCacheMiss {
+		check(c, err)
+	}
+	// 読み込んでいる間に patchTop が書き換えたキャッシュがあれば、そちらを残す
+	err = memcache.Gob.Add(c, &memcache.Item{Key: topCacheKey(kind), Object: top, Expiration: topMemcacheExpiration})
+	if err == memcache.ErrNotStored {
+		return top, nil
+	}
+	check(c, err)
+	setLocalTop(kind, top)
+	return top, nil
+}
+
+/**
+ * キャッシュを捨てる
+ * 次に getRanking が呼ばれたときに datastore から読み込み直す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} kind kind 名
+ */
+func invalidateTop(c appengine.Context, kind string) {
+	var err error
+	setLocalTop(kind, nil)
+	err = memcache.Delete(c, topCacheKey(kind))
+	if err != nil && err != memcache.ErrCacheMiss {
+		check(c, err)
+	}
+}
+
+/**
+ * ランキングのすべての kind のキャッシュを捨てる
+ * 並び順の設定を変えたときに呼び出す
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @returns {error} エラー
+ */
+func (this *Board) invalidateTops(c appengine.Context) error {
+	var kinds []string
+	var i int
+	var err error
+	
+	kinds, err = this.kinds(c)
+	if err != nil {
+		return err
+	}
+	for i = 0; i < len(kinds); i++ {
+		invalidateTop(c, kinds[i])
+	}
+	return nil
+}
+
+/**
+ * 登録した得点でキャッシュを書き換える
+ * 他のインスタンスと同時に書き換えないように memcache の CompareAndSwap を使う
+ * 書き換えられなければキャッシュを捨てる
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} kind kind 名
+ * @param {*datastore.Key} key 登録したエンティティのキー
+ * @param {*Entity} entity 登録したデータ
+ * @param {bool} replaced 同じキーのデータを上書きしたなら true（自己ベストを更新したときなど）
+ */
+func (this *Board) patchTop(c appengine.Context, kind string, key *datastore.Key, entity *Entity, replaced bool) {
+	var top *TopCache
+	var item *memcache.Item
+	var i int
+	var err error
+	
+	for i = 0; i < topPatchAttempts; i++ {
+		top = new(TopCache)
+		item, err = memcache.Gob.Get(c, topCacheKey(kind), top)
+		if err == memcache.ErrCacheMiss {
+			// まだ読み込まれていないので、次の getRanking で読み込めばよい
+			// 今読み込んでいる loadTop がこの登録を含まない内容をキャッシュしないように印を付ける
+			setLocalTop(kind, nil)
+			err = memcache.Set(c, &memcache.Item{Key: topDirtyKey(kind), Value: []byte{1}, Expiration: topDirtyExpiration})
+			check(c, err)
+			return
+		}
+		if err != nil {
+			break
+		}
+		if !top.insert(key.Encode(), entity, replaced) {
+			break
+		}
+		item.Object = top
+		err = memcache.Gob.CompareAndSwap(c, item)
+		if err == nil {
+			setLocalTop(kind, top)
+			return
+		}
+		if err != memcache.ErrCASConflict {
+			break
+		}
+	}
+	check(c, err)
+	invalidateTop(c, kind)
+}
+
+/**
+ * キャッシュに登録したデータを並び順の位置に加える
+ * 上書きしたときは同じキーの古いデータを取り除く（キャッシュになければ上位の外にあったものとして件数だけ減らす）
+ * @method
+ * @memberof TopCache
+ * @param {string} key 登録したエンティティのキー
+ * @param {*Entity} entity 登録したデータ
+ * @param {bool} replaced 同じキーのデータを上書きしたなら true
+ * @returns {bool} 書き換えられたら true（キャッシュの内容が足りなくなったら false）
+ */
+func (this *TopCache) insert(key string, entity *Entity, replaced bool) bool {
+	var complete bool
+	var position int
+	var i int
+	
+	if replaced {
+		for i = 0; i < len(this.Keys); i++ {
+			if this.Keys[i] == key {
+				this.Keys = append(this.Keys[:i], this.Keys[i + 1:]...)
+				this.Entities = append(this.Entities[:i], this.Entities[i + 1:]...)
+				break
+			}
+		}
+		this.Total--
+	}
+	
+	// すべてのデータがキャッシュに入っていれば末尾にも加えられる
+	complete = len(this.Entities) == this.Total
+	this.Total++
+	position = sort.Search(len(this.Entities), func(i int) bool {
+		return this.Entities[i].SortKey > entity.SortKey
+	})
+	if position < len(this.Entities) || complete {
+		var stored *Entity
+		stored = new(Entity)
+		*stored = *entity
+		this.Keys = append(this.Keys, "")
+		copy(this.Keys[position + 1:], this.Keys[position:])
+		this.Keys[position] = key
+		this.Entities = append(this.Entities, nil)
+		copy(this.Entities[position + 1:], this.Entities[position:])
+		this.Entities[position] = stored
+	}
+	if len(this.Entities) > topCacheSize {
+		this.Keys = this.Keys[:topCacheSize]
+		this.Entities = this.Entities[:topCacheSize]
+	}
+	return len(this.Entities) == this.Total || len(this.Entities) == topCacheSize
+}
+
+/**
+ * キャッシュだけで getRanking に応答できるかどうか
+ * @method
+ * @memberof TopCache
+ * @param {int} position 取得を始める位置
+ * @param {int} limit 取得する件数
+ * @returns {bool} 応答できれば true
+ */
+func (this *TopCache) covers(position int, limit int) bool {
+	return position + limit <= len(this.Entities) || len(this.Entities) == this.Total
+}
+
+/**
+ * キャッシュから getRanking の応答を出力する
+ * 順位はキャッシュの先頭から数え、順位の変動と表示名もキャッシュから付けるので datastore を読まない
+ * 表示名がキャッシュに入っていないプレイヤー（キャッシュを書き換えて加えたデータ）の分だけ datastore から読み込む
+ * 出力するときに表示名に置き換えるので、エンティティは複製して使う
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @param {*Board} board ランキングの設定
+ * @param {*TopCache} top キャッシュ
+ * @param {int} limit 取得する件数
+ * @param {int} position 取得を始める位置
+ */
+func writeCachedRanking(c appengine.Context, w http.ResponseWriter, r *http.Request, board *Board, top *TopCache, limit int, position int) {
+	var end int
+	var entities []*Entity
+	var entity *Entity
+	var missing []*Entity
+	var ok bool
+	var i int
+	
+	if position > len(top.Entities) {
+		position = len(top.Entities)
+	}
+	end = position + limit
+	if end > len(top.Entities) {
+		end = len(top.Entities)
+	}
+	entities = make([]*Entity, end - position)
+	for i = position; i < end; i++ {
+		entity = new(Entity)
+		*entity = *top.Entities[i]
+		entities[i - position] = entity
+		if _, ok = top.DisplayNames[entity.Player]; entity.Player != "" && !ok {
+			missing = append(missing, entity)
+		}
+	}
+	
+	if r.FormValue("format") != "envelope" {
+		applyDisplayNames(entities, top.DisplayNames)
+		showDisplayNames(c, missing)
+		writeJSON(c, w, entities)
+		return
+	}
+	
+	var page *RankingPage
+	var rank int
+	page = new(RankingPage)
+	if end < top.Total {
+		page.Cursor = strconv.Itoa(end) + "."
+	}
+	page.Entries = make([]*RankedEntity, len(entities))
+	rank = position + 1
+	// 空のページでなければ、同じ成績の前のデータと同じ順位にする
+	for rank > 1 && position < len(top.Entities) && board.rankKey(top.Entities[rank - 2]) == board.rankKey(top.Entities[position]) {
+		rank--
+	}
+	for i = position; i < end; i++ {
+		if i > position && board.rankKey(top.Entities[i]) != board.rankKey(top.Entities[i - 1]) {
+			rank = i + 1
+		}
+		page.Entries[i - position] = &RankedEntity{Rank: rank, Key: top.Keys[i], Entity: entities[i - position]}
+	}
+	applyChanges(page.Entries, top.PreviousRanks)
+	applyDisplayNames(entities, top.DisplayNames)
+	showDisplayNames(c, missing)
+	if r.FormValue("cursor") == "" {
+		var total int
+		total = top.Total
+		page.Total = &total
+	}
+	
+	writeJSON(c, w, page)
+}
+
+/**
+ * ランキングのキャッシュの使用状況を取得する
+ * Hits と Misses はこのインスタンスで数えた回数、Memcache は memcache 全体の統計
+ * 管理者のみ実行できる
+ * /getcachestats
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func getCacheStats(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var result *CacheStats
+	var err error
+	
+	c = appengine.NewContext(r)
+	if !requireAdmin(c, w, r) {
+		return
+	}
+	result = new(CacheStats)
+	result.Hits = atomic.LoadInt64(&topHits)
+	result.Misses = atomic.LoadInt64(&topMisses)
+	topCachesLock.Lock()
+	result.Kinds = len(topCaches)
+	topCachesLock.Unlock()
+	result.Memcache, err = memcache.Stats(c)
+	check(c, err)
+	
+	writeJSON(c, w, result)
+}
@@ -0,0 +1,142 @@
+package okanoworld
+
+import(
+	"fmt"
+	"testing"
+)
+
+/**
+ * テスト用のキャッシュを作る
+ * i 番目のエンティティはキーが k{i}、並び順のキーが i * 10 になる
+ * @function
+ * @param {int} size キャッシュに入れる件数
+ * @param {int} total ランキングの登録件数
+ * @returns {*TopCache} キャッシュ
+ */
+func newTestTopCache(size int, total int) *TopCache {
+	var top *TopCache
+	var i int
+	
+	top = new(TopCache)
+	top.Total = total
+	for i = 0; i < size; i++ {
+		top.Keys = append(top.Keys, fmt.Sprintf("k%d", i))
+		top.Entities = append(top.Entities, &Entity{SortKey: fmt.Sprintf("%06d", i * 10)})
+	}
+	return top
+}
+
+/**
+ * TopCache.insert が登録したデータを並び順の位置に加え、キャッシュを使い続けられるかどうかを返すこと
+ * @function
+ * @param {*testing.T} t テスト
+ */
+func TestTopCacheInsert(t *testing.T) {
+	var tests []struct {
+		name string
+		size int
+		total int
+		key string
+		sortKey int
+		replaced bool
+		ok bool
+		length int
+		newTotal int
+		position int
+	}
+	var top *TopCache
+	var found int
+	var ok bool
+	var i, j int
+	
+	tests = []struct {
+		name string
+		size int
+		total int
+		key string
+		sortKey int
+		replaced bool
+		ok bool
+		length int
+		newTotal int
+		position int
+	}{
+		{"empty", 0, 0, "new", 5, false, true, 1, 1, 0},
+		{"complete, first", 3, 3, "new", -5, false, true, 4, 4, 0},
+		{"complete, last", 3, 3, "new", 25, false, true, 4, 4, 3},
+		{"complete, replaced upward", 3, 3, "k2", 5, true, true, 3, 3, 1},
+		{"complete, replaced downward", 3, 3, "k0", 25, true, true, 3, 3, 2},
+		{"full, middle", topCacheSize, 150, "new", 55, false, true, topCacheSize, 151, 6},
+		{"full, below the cache", topCacheSize, 150, "new", topCacheSize * 10 + 5, false, true, topCacheSize, 151, -1},
+		{"full, fills up to the size", topCacheSize - 1, topCacheSize - 1, "new", topCacheSize * 10 + 5, false, true, topCacheSize, topCacheSize, topCacheSize - 1},
+		{"full, replaced from outside", topCacheSize, 150, "out", 55, true, true, topCacheSize, 150, 6},
+		{"full, replaced out of the cache", topCacheSize, 150, "k10", topCacheSize * 10 + 5, true, false, topCacheSize - 1, 150, -1},
+		{"incomplete, middle", 50, 150, "new", 55, false, false, 51, 151, 6},
+	}
+	for i = 0; i < len(tests); i++ {
+		top = newTestTopCache(tests[i].size, tests[i].total)
+		ok = top.insert(tests[i].key, &Entity{SortKey: fmt.Sprintf("%06d", tests[i].sortKey)}, tests[i].replaced)
+		if ok != tests[i].ok {
+			t.Errorf("%s: insert = %v, want %v", tests[i].name, ok, tests[i].ok)
+		}
+		if len(top.Entities) != tests[i].length || len(top.Keys) != tests[i].length {
+			t.Errorf("%s: len(Entities), len(Keys) = %d, %d, want %d", tests[i].name, len(top.Entities), len(top.Keys), tests[i].length)
+		}
+		if top.Total != tests[i].newTotal {
+			t.Errorf("%s: Total = %d, want %d", tests[i].name, top.Total, tests[i].newTotal)
+		}
+		found = -1
+		for j = 0; j < len(top.Keys); j++ {
+			if top.Keys[j] == tests[i].key {
+				found = j
+			}
+		}
+		if found != tests[i].position {
+			t.Errorf("%s: position = %d, want %d", tests[i].name, found, tests[i].position)
+		}
+		for j = 1; j < len(top.Entities); j++ {
+			if top.Entities[j - 1].SortKey > top.Entities[j].SortKey {
+				t.Errorf("%s: entities are not sorted at %d", tests[i].name, j)
+				break
+			}
+		}
+	}
+}
+
+/**
+ * TopCache.covers がキャッシュだけで応答できる範囲を判定すること
+ * @function
+ * @param {*testing.T} t テスト
+ */
+func TestTopCacheCovers(t *testing.T) {
+	var tests []struct {
+		size int
+		total int
+		position int
+		limit int
+		covers bool
+	}
+	var top *TopCache
+	var i int
+	
+	tests = []struct {
+		size int
+		total int
+		position int
+		limit int
+		covers bool
+	}{
+		{topCacheSize, 150, 0, 10, true},
+		{topCacheSize, 150, 90, 10, true},
+		{topCacheSize, 150, 91, 10, false},
+		{30, 30, 20, 20, true},
+		{30, 30, 40, 10, true},
+		{0, 0, 0, 10, true},
+	}
+	for i = 0; i < len(tests); i++ {
+		top = newTestTopCache(tests[i].size, tests[i].total)
+		if top.covers(tests[i].position, tests[i].limit) != tests[i].covers {
+			t.Errorf("covers(%d, %d) with %d/%d = %v, want %v", tests[i].position, tests[i].limit, tests[i].size, tests[i].total, !tests[i].covers, tests[i].covers)
+		}
+	}
+}
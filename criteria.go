@@ -0,0 +1,159 @@
+package okanoworld
+
+import(
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/**
+ * 1つのランキングに宣言できる順位の基準の数（得点を除く）
+ */
+const maxCriteria = 5
+
+/**
+ * 得点の次に順位を決める基準（クリアタイム、手数など）
+ * Board.Criteria には "名前:並び順" の文字列で保存する（例: time:asc, combo:desc）
+ * 得点が同じなら宣言した順に比べ、すべて同じなら同じ順位になる
+ * @class
+ * @member {string} Name 基準の名前
+ * @member {bool} Ascending true なら値の低い方を上位にする
+ */
+type Criterion struct {
+	Name string
+	Ascending bool
+}
+
+/**
+ * 順位の基準の宣言を解析する
+ * @function
+ * @param {string} str "名前:並び順" の文字列（並び順は asc または desc、省略時は desc）
+ * @returns {*Criterion} 順位の基準
+ * @returns {error} 正しくなければエラー
+ */
+func parseCriterion(str string) (*Criterion, error) {
+	var parts []string
+	var criterion *Criterion
+	
+	parts = strings.Split(str, ":")
+	if len(parts) > 2 || parts[0] == "" {
+		return nil, errors.New("順位の基準は 名前:並び順 で指定してください: " + str)
+	}
+	
+	criterion = new(Criterion)
+	criterion.Name = parts[0]
+	if len(parts) == 2 {
+		switch parts[1] {
+		case "asc":
+			criterion.Ascending = true
+		case "desc":
+		default:
+			return nil, errors.New("順位の基準の並び順は asc か desc です: " + str)
+		}
+	}
+	return criterion, nil
+}
+
+/**
+ * 順位の基準の一覧を解析する
+ * @function
+ * @param {string} str カンマ区切りの宣言
+ * @returns {[]string} Board.Criteria に保存する宣言
+ * @returns {error} 正しくなければエラー
+ */
+func parseCriteria(str string) ([]string, error) {
+	var specs []string
+	var names map[string]bool
+	var criterion *Criterion
+	var i int
+	var err error
+	
+	if str == "" {
+		return []string{}, nil
+	}
+	specs = strings.Split(str, ",")
+	if len(specs) > maxCriteria {
+		return nil, errors.New("順位の基準が多すぎます")
+	}
+	names = make(map[string]bool)
+	for i = 0; i < len(specs); i++ {
+		criterion, err = parseCriterion(specs[i])
+		if err != nil {
+			return nil, err
+		}
+		if names[criterion.Name] {
+			return nil, errors.New("順位の基準の名前が重複しています: " + criterion.Name)
+		}
+		names[criterion.Name] = true
+	}
+	return specs, nil
+}
+
+/**
+ * ランキングの順位の基準を返す
+ * putBoard で検査済みなので、解析できない宣言は読み飛ばす
+ * @method
+ * @memberof Board
+ * @returns {[]*Criterion} 順位の基準（宣言した順）
+ */
+func (this *Board) criteria() []*Criterion {
+	var result []*Criterion
+	var criterion *Criterion
+	var i int
+	var err error
+	
+	result = make([]*Criterion, 0, len(this.Criteria))
+	for i = 0; i < len(this.Criteria); i++ {
+		criterion, err = parseCriterion(this.Criteria[i])
+		if err != nil {
+			continue
+		}
+		result = append(result, criterion)
+	}
+	return result
+}
+
+/**
+ * リクエストから順位の基準の値を読み取る
+ * 値は score.基準の名前 で送信する（例: score=3&score.time=5230）
+ * required が false なら、すべて省略したときに nil を返す
+ * @method
+ * @memberof Board
+ * @param {*http.Request} r リクエスト
+ * @param {bool} required true ならすべての値を必須にする
+ * @returns {[]int} Board.Criteria と同じ順の値
+ * @returns {error} 正しくなければエラー
+ */
+func (this *Board) requestValues(r *http.Request, required bool) ([]int, error) {
+	var criteria []*Criterion
+	var values []int
+	var value string
+	var given int
+	var i int
+	var err error
+	
+	criteria = this.criteria()
+	values = make([]int, len(criteria))
+	for i = 0; i < len(criteria); i++ {
+		value = r.FormValue("score." + criteria[i].Name)
+		if value == "" {
+			continue
+		}
+		values[i], err = strconv.Atoi(value)
+		if err != nil {
+			return nil, errors.New("score." + criteria[i].Name + " が正しくありません")
+		}
+		given++
+	}
+	if given == 0 && !required {
+		return nil, nil
+	}
+	if given < len(criteria) {
+		return nil, errors.New("順位の基準の値をすべて指定してください")
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+	return values, nil
+}
@@ -0,0 +1,148 @@
+package okanoworld
+
+import(
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+/**
+ * parseCriterion が "名前:並び順" を解析し、正しくない宣言を拒否すること
+ * @function
+ * @param {*testing.T} t テスト
+ */
+func TestParseCriterion(t *testing.T) {
+	var tests []struct {
+		str string
+		criterion *Criterion
+	}
+	var criterion *Criterion
+	var err error
+	var i int
+	
+	tests = []struct {
+		str string
+		criterion *Criterion
+	}{
+		{"time", &Criterion{"time", false}},
+		{"time:asc", &Criterion{"time", true}},
+		{"combo:desc", &Criterion{"combo", false}},
+		{"", nil},
+		{":asc", nil},
+		{"time:up", nil},
+		{"time:asc:desc", nil},
+	}
+	for i = 0; i < len(tests); i++ {
+		criterion, err = parseCriterion(tests[i].str)
+		if tests[i].criterion == nil {
+			if err == nil {
+				t.Errorf("parseCriterion(%q) succeeded, want error", tests[i].str)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(criterion, tests[i].criterion) {
+			t.Errorf("parseCriterion(%q) = %v, %v, want %v", tests[i].str, criterion, err, tests[i].criterion)
+		}
+	}
+}
+
+/**
+ * parseCriteria が数と名前の重複を検査すること
+ * @function
+ * @param {*testing.T} t テスト
+ */
+func TestParseCriteria(t *testing.T) {
+	var tests []struct {
+		str string
+		specs []string
+		ok bool
+	}
+	var specs []string
+	var err error
+	var i int
+	
+	tests = []struct {
+		str string
+		specs []string
+		ok bool
+	}{
+		{"", []string{}, true},
+		{"time:asc", []string{"time:asc"}, true},
+		{"time:asc,combo", []string{"time:asc", "combo"}, true},
+		{"a,b,c,d,e", []string{"a", "b", "c", "d", "e"}, true},
+		{"a,b,c,d,e,f", nil, false},
+		{"time:asc,time:desc", nil, false},
+		{"time:asc,", nil, false},
+	}
+	for i = 0; i < len(tests); i++ {
+		specs, err = parseCriteria(tests[i].str)
+		if (err == nil) != tests[i].ok {
+			t.Errorf("parseCriteria(%q) error = %v, want ok = %v", tests[i].str, err, tests[i].ok)
+			continue
+		}
+		if tests[i].ok && !reflect.DeepEqual(specs, tests[i].specs) {
+			t.Errorf("parseCriteria(%q) = %v, want %v", tests[i].str, specs, tests[i].specs)
+		}
+	}
+}
+
+/**
+ * requestValues が score.基準の名前 を宣言した順に読み取り、一部だけの指定を拒否すること
+ * @function
+ * @param {*testing.T} t テスト
+ */
+func TestRequestValues(t *testing.T) {
+	var tests []struct {
+		query string
+		required bool
+		values []int
+		ok bool
+	}
+	var board *Board
+	var values []int
+	var err error
+	var i int
+	
+	board = &Board{Criteria: []string{"time:asc", "combo"}}
+	tests = []struct {
+		query string
+		required bool
+		values []int
+		ok bool
+	}{
+		{"score.combo=20&score.time=5230", true, []int{5230, 20}, true},
+		{"score.time=-1&score.combo=0", true, []int{-1, 0}, true},
+		{"", false, nil, true},
+		{"", true, nil, false},
+		{"score.time=5230", false, nil, false},
+		{"score.time=abc&score.combo=20", true, nil, false},
+	}
+	for i = 0; i < len(tests); i++ {
+		values, err = board.requestValues(&http.Request{Form: parseTestQuery(tests[i].query)}, tests[i].required)
+		if (err == nil) != tests[i].ok {
+			t.Errorf("requestValues(%q, %v) error = %v, want ok = %v", tests[i].query, tests[i].required, err, tests[i].ok)
+			continue
+		}
+		if tests[i].ok && !reflect.DeepEqual(values, tests[i].values) {
+			t.Errorf("requestValues(%q, %v) = %v, want %v", tests[i].query, tests[i].required, values, tests[i].values)
+		}
+	}
+	
+	values, err = new(Board).requestValues(&http.Request{Form: url.Values{}}, true)
+	if values != nil || err != nil {
+		t.Errorf("requestValues without criteria = %v, %v, want nil, nil", values, err)
+	}
+}
+
+/**
+ * テスト用にクエリ文字列を解析する
+ * @function
+ * @param {string} query クエリ文字列
+ * @returns {url.Values} パラメータ
+ */
+func parseTestQuery(query string) url.Values {
+	var values url.Values
+	values, _ = url.ParseQuery(query)
+	return values
+}
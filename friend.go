@@ -0,0 +1,552 @@
+package okanoworld
+
+import(
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+	"appengine"
+	"appengine/datastore"
+)
+
+/**
+ * 1人のプレイヤーが登録できるフレンドの数
+ */
+const maxFriends = 200
+
+/**
+ * フレンドが多すぎるときのエラー
+ */
+var errTooManyFriends = errors.New("フレンドが多すぎます")
+
+/**
+ * プレイヤーのフレンドの一覧
+ * datastore には kind "FriendList"、キー名をプレイヤーIDとして保存する
+ * フレンドは双方向で、相手が申請を承認したときに両方のプレイヤーの一覧に加える
+ * 申請は古いものから捨てて maxFriends 件まで保持する（申請が多くてもフレンドを登録できなくならないようにする）
+ * @class
+ * @member {[]string} Friends フレンドのプレイヤーID
+ * @member {[]string} Requests 承認待ちの申請をしてきたプレイヤーID（古い順）
+ * @member {time.Time} Updated 更新日時
+ */
+type FriendList struct {
+	Friends []string `datastore:",noindex"`
+	Requests []string `datastore:",noindex"`
+	Updated time.Time
+}
+
+/**
+ * フレンドの一覧のキーを返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} name プレイヤーID
+ * @returns {*datastore.Key} キー
+ */
+func friendListKey(c appengine.Context, name string) *datastore.Key {
+	return datastore.NewKey(c, "FriendList", name, 0, nil)
+}
+
+/**
+ * フレンドの一覧を読み込む
+ * まだ一覧がなければ空の一覧を返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} name プレイヤーID
+ * @returns {*FriendList} フレンドの一覧
+ * @returns {error} エラー
+ */
+func loadFriends(c appengine.Context, name string) (*FriendList, error) {
+	var list *FriendList
+	var err error
+	
+	list = new(FriendList)
+	err = datastore.Get(c, friendListKey(c, name), list)
+	if err == datastore.ErrNoSuchEntity {
+		list.Friends = []string{}
+		list.Requests = []string{}
+		return list, nil
+	}
+	return list, err
+}
+
+/**
+ * 名前のリストに名前が含まれているかどうか
+ * @function
+ * @param {[]string} names 名前のリスト
+ * @param {string} name 名前
+ * @returns {bool} 含まれていれば true
+ */
+func containsName(names []string, name string) bool {
+	var i int
+	for i = 0; i < len(names); i++ {
+		if names[i] == name {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * 名前のリストから名前を取り除いたリストを返す
+ * @function
+ * @param {[]string} names 名前のリスト
+ * @param {string} name 取り除く名前
+ * @returns {[]string} 取り除いたリスト
+ */
+func withoutName(names []string, name string) []string {
+	var result []string
+	var i int
+	
+	result = make([]string, 0, len(names))
+	for i = 0; i < len(names); i++ {
+		if names[i] != name {
+			result = append(result, names[i])
+		}
+	}
+	return result
+}
+
+/**
+ * フレンドの一覧を更新する
+ * 同時に更新されても失われないようにトランザクション内で読み込んで update を呼び出す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} name 一覧を更新するプレイヤーID
+ * @param {func(*FriendList) error} update 一覧を書き換える関数
+ * @returns {*FriendList} 更新後のフレンドの一覧
+ * @returns {error} エラー（update が返したエラーを含む）
+ */
+func updateFriends(c appengine.Context, name string, update func(*FriendList) error) (*FriendList, error) {
+	var list *FriendList
+	var err error
+	
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var err error
+		
+		list, err = loadFriends(c, name)
+		if err != nil {
+			return err
+		}
+		err = update(list)
+		if err != nil {
+			return err
+		}
+		list.Updated = time.Now()
+		_, err = datastore.Put(c, friendListKey(c, name), list)
+		return err
+	}, nil)
+	return list, err
+}
+
+/**
+ * フレンドを申請する（または申請を承認する）
+ * 相手から申請が来ていれば承認して両方の一覧に加え、来ていなければ相手の一覧に申請を残す
+ * /addfriend?player=xxxxxx&token=xxxxxx&friend=xxxxxx
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func addFriend(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var name string
+	var friend string
+	var list *FriendList
+	var accepted bool
+	var err error
+	
+	c = appengine.NewContext(r)
+	name, friend = requestFriend(c, w, r)
+	if name == "" {
+		return
+	}
+	if isBanned(c, name) || isBanned(c, friend) {
+		writeError(c, w, http.StatusForbidden, "このプレイヤーは出場停止中です")
+		return
+	}
+	
+	list, err = updateFriends(c, name, func(list *FriendList) error {
+		accepted = containsName(list.Requests, friend)
+		if !accepted {
+			return nil
+		}
+		list.Requests = withoutName(list.Requests, friend)
+		if containsName(list.Friends, friend) {
+			return nil
+		}
+		if len(list.Friends) >= maxFriends {
+			return errTooManyFriends
+		}
+		list.Friends = append(list.Friends, friend)
+		return nil
+	})
+	if err == errTooManyFriends {
+		writeError(c, w, http.StatusBadRequest, err.Error())
+		return
+	}
+	check(c, err)
+	if err != nil {
+		writeError(c, w, http.StatusInternalServerError, "フレンドを更新できませんでした")
+		return
+	}
+	if !accepted && containsName(list.Friends, friend) {
+		writeJSON(c, w, list)
+		return
+	}
+	
+	_, err = updateFriends(c, friend, func(list *FriendList) error {
+		if accepted {
+			if containsName(list.Friends, name) {
+				return nil
+			}
+			if len(list.Friends) >= maxFriends {
+				return errTooManyFriends
+			}
+			list.Friends = append(list.Friends, name)
+			return nil
+		}
+		if containsName(list.Requests, name) || containsName(list.Friends, name) {
+			return nil
+		}
+		list.Requests = append(list.Requests, name)
+		if len(list.Requests) > maxFriends {
+			list.Requests = list.Requests[len(list.Requests) - maxFriends:]
+		}
+		return nil
+	})
+	if err == errTooManyFriends {
+		// 相手の一覧に入らなければ片方だけの登録にならないように元に戻す
+		_, err = updateFriends(c, name, func(list *FriendList) error {
+			list.Friends = withoutName(list.Friends, friend)
+			return nil
+		})
+		check(c, err)
+		writeError(c, w, http.StatusBadRequest, "相手のフレンドが多すぎます")
+		return
+	}
+	check(c, err)
+	
+	writeJSON(c, w, list)
+}
+
+/**
+ * フレンドの登録を解除する
+ * 両方のプレイヤーの一覧から互いを取り除き、承認待ちの申請も取り消す（申請を断るときにも使う）
+ * /removefriend?player=xxxxxx&token=xxxxxx&friend=xxxxxx
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func removeFriend(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var name string
+	var friend string
+	var list *FriendList
+	var err error
+	
+	c = appengine.NewContext(r)
+	name, friend = requestFriend(c, w, r)
+	if name == "" {
+		return
+	}
+	
+	list, err = updateFriends(c, name, func(list *FriendList) error {
+		list.Friends = withoutName(list.Friends, friend)
+		list.Requests = withoutName(list.Requests, friend)
+		return nil
+	})
+	check(c, err)
+	if err != nil {
+		writeError(c, w, http.StatusInternalServerError, "フレンドを更新できませんでした")
+		return
+	}
+	_, err = updateFriends(c, friend, func(list *FriendList) error {
+		list.Friends = withoutName(list.Friends, name)
+		list.Requests = withoutName(list.Requests, name)
+		return nil
+	})
+	check(c, err)
+	
+	writeJSON(c, w, list)
+}
+
+/**
+ * addFriend と removeFriend の共通部分
+ * player と token でプレイヤーを確認し、friend が登録済みのプレイヤーかどうかを確認する
+ * 確認できなければエラーを出力する
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @returns {string} プレイヤーID（エラーなら空文字列）
+ * @returns {string} 相手のプレイヤーID
+ */
+func requestFriend(c appengine.Context, w http.ResponseWriter, r *http.Request) (string, string) {
+	var player *Player
+	var friend string
+	var err error
+	
+	player = requestPlayer(c, w, r)
+	if player == nil {
+		return "", ""
+	}
+	friend = r.FormValue("friend")
+	if friend == "" || friend == player.ID {
+		writeError(c, w, http.StatusBadRequest, "friend に相手のプレイヤーIDを指定してください")
+		return "", ""
+	}
+	_, err = loadPlayer(c, friend)
+	if err == datastore.ErrNoSuchEntity {
+		writeError(c, w, http.StatusNotFound, "プレイヤーが見つかりません")
+		return "", ""
+	}
+	check(c, err)
+	if err != nil {
+		writeError(c, w, http.StatusInternalServerError, "プレイヤーを読み込めませんでした")
+		return "", ""
+	}
+	return player.ID, friend
+}
+
+/**
+ * フレンドの一覧と承認待ちの申請を取得する
+ * /getfriends?player=xxxxxx&token=xxxxxx
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func getFriends(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var player *Player
+	var list *FriendList
+	var err error
+	
+	c = appengine.NewContext(r)
+	player = requestPlayer(c, w, r)
+	if player == nil {
+		return
+	}
+	list, err = loadFriends(c, player.ID)
+	check(c, err)
+	
+	writeJSON(c, w, list)
+}
+
+/**
+ * フレンドのランキングを getRanking の応答として出力する
+ * プレイヤー本人とフレンドの最高得点だけを集めて、その中で順位を付ける
+ * 件数が少ないので cursor には対応せず offset で取得する
+ * フレンドの一覧は本人しか見られないので、friends と同じプレイヤーの player と token が必要
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @param {*Board} board ランキングの設定
+ * @param {string} kind ランキングの kind 名
+ * @param {int} limit 取得する件数
+ * @param {int} offset 読み飛ばす件数
+ */
+func writeFriendRanking(c appengine.Context, w http.ResponseWriter, r *http.Request, board *Board, kind string, limit int, offset int) {
+	var player *Player
+	var list *FriendList
+	var names []string
+	var keys []*datastore.Key
+	var entities []*Entity
+	var i int
+	var err error
+	
+	player = requestPlayer(c, w, r)
+	if player == nil {
+		return
+	}
+	if player.ID != r.FormValue("friends") {
+		writeError(c, w, http.StatusForbidden, "friends には自分のプレイヤーIDを指定してください")
+		return
+	}
+	list, err = loadFriends(c, player.ID)
+	check(c, err)
+	if err != nil {
+		writeError(c, w, http.StatusInternalServerError, "フレンドを読み込めませんでした")
+		return
+	}
+	names = append([]string{player.ID}, list.Friends...)
+	
+	if board.BestOnly {
+		keys, entities, err = friendEntriesByKey(c, kind, names)
+	} else {
+		keys, entities, err = friendEntriesByQuery(c, board, kind, names)
+	}
+	check(c, err)
+	if err != nil {
+		writeError(c, w, http.StatusInternalServerError, "ランキングを読み込めませんでした")
+		return
+	}
+	for i = 0; i < len(entities); i++ {
+		entities[i].SortKey = board.sortKey(entities[i])
+	}
+	sort.Sort(&entrySorter{keys, entities})
+	showDisplayNames(c, entities)
+	
+	// フレンドの中での順位（同じ成績なら同じ順位）
+	var ranked []*RankedEntity
+	ranked = make([]*RankedEntity, len(entities))
+	for i = 0; i < len(entities); i++ {
+		if i > 0 && board.rankKey(entities[i]) == board.rankKey(entities[i - 1]) {
+			ranked[i] = newRankedEntity(ranked[i - 1].Rank, keys[i], entities[i])
+		} else {
+			ranked[i] = newRankedEntity(i + 1, keys[i], entities[i])
+		}
+	}
+	var total int
+	total = len(ranked)
+	if offset > len(ranked) {
+		offset = len(ranked)
+	}
+	ranked = ranked[offset:]
+	if limit < len(ranked) {
+		ranked = ranked[:limit]
+	}
+	
+	if r.FormValue("format") != "envelope" {
+		entities = make([]*Entity, len(ranked))
+		for i = 0; i < len(ranked); i++ {
+			entities[i] = ranked[i].Entity
+		}
+		writeJSON(c, w, entities)
+		return
+	}
+	
+	var page *RankingPage
+	page = new(RankingPage)
+	page.Entries = ranked
+	page.Total = &total
+	writeJSON(c, w, page)
+}
+
+/**
+ * キーとランキングデータを並び順のキーで並べ替える
+ * @class
+ * @member {[]*datastore.Key} keys キーのリスト
+ * @member {[]*Entity} entities ランキングデータのリスト
+ */
+type entrySorter struct {
+	keys []*datastore.Key
+	entities []*Entity
+}
+
+/**
+ * 件数を返す
+ * @method
+ * @memberof entrySorter
+ * @returns {int} 件数
+ */
+func (this *entrySorter) Len() int {
+	return len(this.entities)
+}
+
+/**
+ * i 番目が j 番目より前に並ぶかどうか
+ * @method
+ * @memberof entrySorter
+ * @param {int} i 位置
+ * @param {int} j 位置
+ * @returns {bool} 前に並ぶなら true
+ */
+func (this *entrySorter) Less(i int, j int) bool {
+	return this.entities[i].SortKey < this.entities[j].SortKey
+}
+
+/**
+ * i 番目と j 番目を入れ替える
+ * @method
+ * @memberof entrySorter
+ * @param {int} i 位置
+ * @param {int} j 位置
+ */
+func (this *entrySorter) Swap(i int, j int) {
+	this.keys[i], this.keys[j] = this.keys[j], this.keys[i]
+	this.entities[i], this.entities[j] = this.entities[j], this.entities[i]
+}
+
+/**
+ * 自己ベストだけを残すランキングから、プレイヤーたちのエンティティをキーでまとめて読み込む
+ * エンティティのないプレイヤーは飛ばす
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} kind ランキングの kind 名
+ * @param {[]string} names プレイヤーID
+ * @returns {[]*datastore.Key} 見つかったエンティティのキー
+ * @returns {[]*Entity} 見つかったエンティティ
+ * @returns {error} エラー
+ */
+func friendEntriesByKey(c appengine.Context, kind string, names []string) ([]*datastore.Key, []*Entity, error) {
+	var keys []*datastore.Key
+	var entities []*Entity
+	var foundKeys []*datastore.Key
+	var found []*Entity
+	var errs datastore.MultiError
+	var ok bool
+	var i int
+	var err error
+	
+	keys = make([]*datastore.Key, len(names))
+	entities = make([]*Entity, len(names))
+	for i = 0; i < len(names); i++ {
+		keys[i] = datastore.NewKey(c, kind, names[i], 0, nil)
+		entities[i] = new(Entity)
+	}
+	err = datastore.GetMulti(c, keys, entities)
+	errs, ok = err.(datastore.MultiError)
+	if err != nil && !ok {
+		return nil, nil, err
+	}
+	
+	foundKeys = make([]*datastore.Key, 0, len(keys))
+	found = make([]*Entity, 0, len(keys))
+	for i = 0; i < len(keys); i++ {
+		if err != nil && errs[i] != nil {
+			if errs[i] != datastore.ErrNoSuchEntity {
+				check(c, errs[i])
+			}
+			continue
+		}
+		foundKeys = append(foundKeys, keys[i])
+		found = append(found, entities[i])
+	}
+	return foundKeys, found, nil
+}
+
+/**
+ * すべての得点を残すランキングから、プレイヤーたちの最高得点のエンティティを探す
+ * エンティティのないプレイヤーは飛ばす
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {*Board} board ランキングの設定
+ * @param {string} kind ランキングの kind 名
+ * @param {[]string} names プレイヤーID
+ * @returns {[]*datastore.Key} 見つかったエンティティのキー
+ * @returns {[]*Entity} 見つかったエンティティ
+ * @returns {error} エラー
+ */
+func friendEntriesByQuery(c appengine.Context, board *Board, kind string, names []string) ([]*datastore.Key, []*Entity, error) {
+	var keys []*datastore.Key
+	var entities []*Entity
+	var key *datastore.Key
+	var entity *Entity
+	var i int
+	var err error
+	
+	keys = make([]*datastore.Key, 0, len(names))
+	entities = make([]*Entity, 0, len(names))
+	for i = 0; i < len(names); i++ {
+		key, entity, err = findEntry(c, board, kind, "", names[i])
+		if err == datastore.ErrNoSuchEntity {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, key)
+		entities = append(entities, entity)
+	}
+	return keys, entities, nil
+}
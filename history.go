@@ -0,0 +1,377 @@
+package okanoworld
+
+import(
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"appengine"
+	"appengine/datastore"
+)
+
+/**
+ * getHistory の1件分
+ * @member {string} Key エンティティのキー
+ * @member {string} Period 期間（期間ごとの記録のみ、例: 2013-W22）
+ */
+type HistoryEntry struct {
+	Key string
+	Period string `json:",omitempty"`
+	*Entity
+}
+
+/**
+ * 記録の伸び
+ * @member {int} First 最初の記録の得点
+ * @member {int} Latest 最新の記録の得点
+ * @member {float64} PerDay 1日あたりの得点の伸び（最小二乗法、上位に向かう方向を正とする）
+ * @member {int} Improvements 自己ベストを更新した回数
+ */
+type Trend struct {
+	First int
+	Latest int
+	PerDay float64
+	Improvements int
+}
+
+/**
+ * getHistory の応答
+ * @member {*Entity} Best 自己ベスト
+ * @member {[]*HistoryEntry} Entries 記録（ページの中では新しい順）
+ * @member {string} Cursor 次のページのカーソル（最後まで読んだら空文字列）
+ * @member {*int} Total 記録の件数（送信したすべての記録を cursor を指定せずに取得したときのみ）
+ * @member {*Trend} Trend このページの記録の伸び（記録が2件以上あるときのみ）
+ */
+type HistoryResult struct {
+	Best *Entity
+	Entries []*HistoryEntry
+	Cursor string
+	Total *int `json:",omitempty"`
+	Trend *Trend `json:",omitempty"`
+}
+
+/**
+ * periodHistory で一度に調べる期間別ランキングの数
+ * 記録のない期間が続いても、1回のリクエストで調べるのはこの数まで
+ */
+const historyScanLimit = 100
+
+/**
+ * プレイヤーの記録の履歴を取得する
+ * 自己ベストだけを保持しないランキングでは、送信したすべての記録を返す
+ * period を指定すると期間別ランキングに残っている期間ごとの自己ベストを返す
+ * 自己ベストだけを保持するランキングで period を省略すると、集計している一番短い期間を使う
+ * name の代わりに player でプレイヤーIDを指定できる
+ * 前回の応答の cursor で続きのページを取得する
+ * 送信したすべての記録は kind ごとに複合インデックスを用意できないので datastore の順に読み、ページの中だけ新しい順に並べる
+ * 期間ごとの記録は新しい期間から順に返す
+ * /gethistory?kind=xxxxxx&name=xxxxxx&limit=20
+ * /gethistory?kind=xxxxxx&name=xxxxxx&limit=20&cursor=xxxxxx
+ * /gethistory?kind=xxxxxx&player=xxxxxx&period=week
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func getHistory(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var board *Board
+	var name string
+	var period string
+	var limit int
+	var entries []*HistoryEntry
+	var result *HistoryResult
+	var err error
+	
+	c = appengine.NewContext(r)
+	board = requestBoard(c, w, r)
+	if board == nil {
+		return
+	}
+	name = r.FormValue("name")
+	if r.FormValue("player") != "" {
+		name = r.FormValue("player")
+	}
+	if name == "" {
+		writeError(c, w, http.StatusBadRequest, "name か player を指定してください")
+		return
+	}
+	limit = 20
+	if r.FormValue("limit") != "" {
+		limit, err = strconv.Atoi(r.FormValue("limit"))
+		if err != nil || limit < 0 || limit > 100 {
+			writeError(c, w, http.StatusBadRequest, "limit は0から100で指定してください")
+			return
+		}
+	}
+	
+	period = r.FormValue("period")
+	if period == "" && board.BestOnly {
+		period = board.shortestPeriod()
+	}
+	if period != "" && !board.hasPeriod(period) {
+		writeError(c, w, http.StatusBadRequest, "このランキングでは指定された期間を集計していません")
+		return
+	}
+	
+	result = new(HistoryResult)
+	if period != "" {
+		var index int
+		if r.FormValue("cursor") != "" {
+			index, err = strconv.Atoi(r.FormValue("cursor"))
+			if err != nil || index < 0 {
+				writeError(c, w, http.StatusBadRequest, "cursor が正しくありません")
+				return
+			}
+		}
+		entries, index, err = board.periodHistory(c, name, period, index, limit)
+		if index > 0 {
+			result.Cursor = strconv.Itoa(index)
+		}
+	} else {
+		var cursor datastore.Cursor
+		if r.FormValue("cursor") != "" {
+			cursor, err = datastore.DecodeCursor(r.FormValue("cursor"))
+			if err != nil {
+				writeError(c, w, http.StatusBadRequest, "cursor が正しくありません")
+				return
+			}
+		}
+		entries, result.Cursor, err = board.submissionHistory(c, name, cursor, limit)
+		if err == nil && r.FormValue("cursor") == "" {
+			var total int
+			total, err = datastore.NewQuery(board.ID).Filter("Name =", name).KeysOnly().Count(c)
+			result.Total = &total
+		}
+	}
+	check(c, err)
+	if err != nil {
+		writeError(c, w, http.StatusInternalServerError, "記録を読み込めませんでした")
+		return
+	}
+	
+	_, result.Best, err = findEntry(c, board, board.ID, "", name)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		check(c, err)
+	}
+	if len(entries) >= 2 {
+		result.Trend = board.trend(entries)
+	}
+	result.Entries = entries
+	
+	var entities []*Entity
+	var i int
+	entities = make([]*Entity, 0, len(entries) + 1)
+	for i = 0; i < len(entries); i++ {
+		entities = append(entities, entries[i].Entity)
+	}
+	if result.Best != nil {
+		entities = append(entities, result.Best)
+	}
+	showDisplayNames(c, entities)
+	
+	writeJSON(c, w, result)
+}
+
+/**
+ * 集計している一番短い期間を返す
+ * @method
+ * @memberof Board
+ * @returns {string} 期間の種類（集計していなければ空文字列）
+ */
+func (this *Board) shortestPeriod() string {
+	var i int
+	for i = 0; i < len(periods); i++ {
+		if this.hasPeriod(periods[i]) {
+			return periods[i]
+		}
+	}
+	return ""
+}
+
+/**
+ * 通常のランキングに送信した記録を1ページ分返す
+ * kind ごとに複合インデックスを用意できないので名前だけで絞り込み、ページの中だけ新しい順に並べ替える
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} name プレイヤー名
+ * @param {datastore.Cursor} cursor 前のページのカーソル（最初のページならゼロ値）
+ * @param {int} limit 取得する件数
+ * @returns {[]*HistoryEntry} 記録
+ * @returns {string} 次のページのカーソル（最後まで読んだら空文字列）
+ * @returns {error} エラー
+ */
+func (this *Board) submissionHistory(c appengine.Context, name string, cursor datastore.Cursor, limit int) ([]*HistoryEntry, string, error) {
+	var query *datastore.Query
+	var iterator *datastore.Iterator
+	var entries []*HistoryEntry
+	var key *datastore.Key
+	var entity *Entity
+	var err error
+	
+	query = datastore.NewQuery(this.ID).Filter("Name =", name).Limit(limit)
+	if cursor.String() != "" {
+		query = query.Start(cursor)
+	}
+	entries = make([]*HistoryEntry, 0, limit)
+	iterator = query.Run(c)
+	for {
+		entity = new(Entity)
+		key, err = iterator.Next(entity)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		entries = append(entries, &HistoryEntry{key.Encode(), "", entity})
+	}
+	sort.Sort(historySorter(entries))
+	
+	if len(entries) < limit || limit == 0 {
+		return entries, "", nil
+	}
+	cursor, err = iterator.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	return entries, cursor.String(), nil
+}
+
+/**
+ * 期間別ランキングに残っている期間ごとの自己ベストを新しい期間から順に1ページ分返す
+ * 一度に調べる期間は historyScanLimit まで
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} name プレイヤー名
+ * @param {string} period 期間の種類
+ * @param {int} start 新しい方から数えて何番目の期間から調べるか（前のページが返した番号、最初のページなら0）
+ * @param {int} limit 取得する件数
+ * @returns {[]*HistoryEntry} 記録
+ * @returns {int} 次のページで調べ始める番号（最後まで調べたら0）
+ * @returns {error} エラー
+ */
+func (this *Board) periodHistory(c appengine.Context, name string, period string, start int, limit int) ([]*HistoryEntry, int, error) {
+	var kinds []string
+	var prefix string
+	var periodKinds []string
+	var entries []*HistoryEntry
+	var key *datastore.Key
+	var entity *Entity
+	var i int
+	var err error
+	
+	kinds, err = this.kinds(c)
+	if err != nil {
+		return nil, 0, err
+	}
+	prefix = this.ID + "@" + period + ":"
+	for i = len(kinds) - 1; i >= 0; i-- {
+		if strings.HasPrefix(kinds[i], prefix) {
+			periodKinds = append(periodKinds, kinds[i])
+		}
+	}
+	
+	entries = make([]*HistoryEntry, 0, limit)
+	for i = start; i < len(periodKinds) && i < start + historyScanLimit && len(entries) < limit; i++ {
+		key, entity, err = findEntry(c, this, periodKinds[i], "", name)
+		if err == datastore.ErrNoSuchEntity {
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, &HistoryEntry{key.Encode(), strings.TrimPrefix(periodKinds[i], prefix), entity})
+	}
+	sort.Sort(historySorter(entries))
+	if i >= len(periodKinds) || limit == 0 {
+		i = 0
+	}
+	return entries, i, nil
+}
+
+/**
+ * 記録の伸びを求める
+ * @method
+ * @memberof Board
+ * @param {[]*HistoryEntry} entries 新しい順の記録
+ * @returns {*Trend} 記録の伸び
+ */
+func (this *Board) trend(entries []*HistoryEntry) *Trend {
+	var trend *Trend
+	var best *Entity
+	var x, y float64
+	var sumX, sumY, sumXY, sumXX float64
+	var n float64
+	var i int
+	
+	trend = new(Trend)
+	trend.First = entries[len(entries) - 1].Score
+	trend.Latest = entries[0].Score
+	for i = len(entries) - 1; i >= 0; i-- {
+		if best == nil || this.better(entries[i].Entity, best) {
+			if best != nil {
+				trend.Improvements++
+			}
+			best = entries[i].Entity
+		}
+		x = entries[i].Created.Sub(entries[len(entries) - 1].Created).Hours() / 24
+		y = float64(entries[i].Score)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	n = float64(len(entries))
+	if n * sumXX - sumX * sumX != 0 {
+		trend.PerDay = (n * sumXY - sumX * sumY) / (n * sumXX - sumX * sumX)
+	}
+	if this.Ascending {
+		trend.PerDay = -trend.PerDay
+	}
+	return trend
+}
+
+/**
+ * 記録を新しい順に並べ替える
+ * 期間ごとの記録は期間の新しい順、同じ期間なら登録日時の新しい順にする
+ * @class
+ */
+type historySorter []*HistoryEntry
+
+/**
+ * 件数を返す
+ * @method
+ * @memberof historySorter
+ * @returns {int} 件数
+ */
+func (this historySorter) Len() int {
+	return len(this)
+}
+
+/**
+ * i 番目が j 番目より前に並ぶかどうか
+ * @method
+ * @memberof historySorter
+ * @param {int} i 位置
+ * @param {int} j 位置
+ * @returns {bool} 前に並ぶなら true
+ */
+func (this historySorter) Less(i int, j int) bool {
+	if this[i].Period != this[j].Period {
+		return this[i].Period > this[j].Period
+	}
+	return this[i].Created.After(this[j].Created)
+}
+
+/**
+ * i 番目と j 番目を入れ替える
+ * @method
+ * @memberof historySorter
+ * @param {int} i 位置
+ * @param {int} j 位置
+ */
+func (this historySorter) Swap(i int, j int) {
+	this[i], this[j] = this[j], this[i]
+}
@@ -7,12 +7,65 @@ import(
 	"appengine/datastore"
 	"encoding/json"
 	"fmt"
+	"strings"
+	"errors"
+	"time"
 )
 
+/**
+ * getRanking で一度に取得できる件数の上限
+ */
+const maxRankingLimit = 1000
+
 func init() {
+	// プレイヤー
+	http.HandleFunc("/registerplayer", registerPlayer)
+	http.HandleFunc("/getplayer", getPlayer)
+	http.HandleFunc("/putprofile", putProfile)
+	
 	// ランキング
 	http.HandleFunc("/getranking", getRanking)
 	http.HandleFunc("/putranking", putRanking)
+	http.HandleFunc("/getrank", getRank)
+	http.HandleFunc("/getneighbors", getNeighbors)
+	http.HandleFunc("/gethistory", getHistory)
+	http.HandleFunc("/getmovers", getMovers)
+	http.HandleFunc("/getreplay", getReplay)
+	http.HandleFunc("/getboards", getBoards)
+	http.HandleFunc("/putboard", putBoard)
+	http.HandleFunc("/resortboard", resortBoard)
+	http.HandleFunc("/getstats", getStats)
+	http.HandleFunc("/rebuildstats", rebuildStats)
+	http.HandleFunc("/rebuildaggregate", rebuildAggregate)
+	http.HandleFunc("/getrejections", getRejections)
+	
+	// 承認待ち
+	http.HandleFunc("/getpending", getPending)
+	http.HandleFunc("/approvepending", approvePending)
+	http.HandleFunc("/rejectpending", rejectPending)
+	
+	// 管理
+	http.HandleFunc("/deleteentry", deleteEntry)
+	http.HandleFunc("/deleteplayer", deletePlayer)
+	http.HandleFunc("/banplayer", banPlayer)
+	http.HandleFunc("/unbanplayer", unbanPlayer)
+	http.HandleFunc("/wipeboard", wipeBoard)
+	http.HandleFunc("/getaudit", getAudit)
+	http.HandleFunc("/prunereplays", pruneReplays)
+	http.HandleFunc("/snapshotranks", snapshotRanks)
+	http.HandleFunc("/pruneboards", pruneBoards)
+	http.HandleFunc("/prunenonces", pruneNonces)
+	http.HandleFunc("/getcachestats", getCacheStats)
+	
+	// フレンド
+	http.HandleFunc("/addfriend", addFriend)
+	http.HandleFunc("/removefriend", removeFriend)
+	http.HandleFunc("/getfriends", getFriends)
+	
+	// シーズン
+	http.HandleFunc("/putseason", putSeason)
+	http.HandleFunc("/getseasons", getSeasons)
+	http.HandleFunc("/closeseasons", closeSeasons)
 	
 	// 無茶振りBacklog
 	http.HandleFunc("/backlog", requestBacklog);
@@ -22,83 +75,541 @@ func init() {
  * ランキングデータの型
  * @member {string} Name プレイヤー名
  * @member {int} Score 得点
+ * @member {time.Time} Created 登録日時
+ * @member {Metadata} Meta ランキングで宣言された追加項目
+ * @member {[]int} Values 得点が同じときに順位を決める値（Board.Criteria と同じ順）
+ * @member {[]string} Partitions 送信された区分（"名前:値"）
+ * @member {string} Player プレイヤーとして送信した場合はプレイヤーID（Name にもプレイヤーIDを保存する）
+ * @member {string} SortKey 並び順のキー（Board.sortKey を参照）
  */
 type Entity struct {
 	Name string
 	Score int
+	Created time.Time
+	Meta Metadata `datastore:",noindex" json:",omitempty"`
+	Values []int `datastore:",noindex" json:",omitempty"`
+	Partitions []string `datastore:",noindex" json:",omitempty"`
+	Player string `json:",omitempty"`
+	SortKey string `json:"-"`
+}
+
+/**
+ * format=envelope を指定したときの getRanking の応答
+ * @member {[]*RankedEntity} Entries ランキングデータ
+ * @member {string} Cursor 次のページを取得するためのカーソル（最後のページなら空文字列）
+ * @member {*int} Total ランキングの登録件数（cursor を指定しない最初のページのみ）
+ */
+type RankingPage struct {
+	Entries []*RankedEntity
+	Cursor string
+	Total *int `json:",omitempty"`
 }
 
 /**
  * ランキングを取得する
+ * offset か前回の応答の cursor で続きのページを取得できる
+ * format=envelope を指定すると RankingPage を、指定しなければ Entity の配列を返す
+ * RankingPage には前回のスナップショットからの順位の変動も含まれる（snapshotRanks を参照）
+ * 上位 topCacheSize 件に収まるページはキャッシュから返す（TopCache を参照）
+ * period と date で期間別ランキングを、season でシーズンのランキングを取得できる
+ * 終了したシーズンは確定済みの最終順位を返す
+ * friends にプレイヤーIDを指定すると、そのプレイヤーとフレンドだけのランキングを返す（本人の player と token が必要）
+ * /getranking?kind=xxxxxx&limit=10
+ * /getranking?kind=xxxxxx&limit=10&friends=xxxxxx&player=xxxxxx&token=xxxxxx
+ * /getranking?kind=xxxxxx&limit=10&period=day&date=2013-06-01
+ * /getranking?kind=xxxxxx&limit=10&format=envelope&cursor=xxxxxx
  * @function
  */
 func getRanking(w http.ResponseWriter, r *http.Request) {
 	var query *datastore.Query
 	var kind string
-	var entity *Entity
 	var limit int
+	var offset int
+	var position int
 	var err error
 	var c appengine.Context
-	var iterator *datastore.Iterator
-	var count int
-	var i int
+	var keys []*datastore.Key
 	var entities []*Entity
-	var result []byte
+	var next string
+	var board *Board
 
 	c = appengine.NewContext(r)
 	
-	kind = r.FormValue("kind")
+	board = requestBoard(c, w, r)
+	if board == nil {
+		return
+	}
+	kind, err = board.requestKind(c, r)
+	if err != nil {
+		writeError(c, w, http.StatusBadRequest, err.Error())
+		return
+	}
 	limit, err = strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit < 0 || limit > maxRankingLimit {
+		writeError(c, w, http.StatusBadRequest, "limit は0から" + strconv.Itoa(maxRankingLimit) + "で指定してください")
+		return
+	}
+	if r.FormValue("offset") != "" {
+		offset, err = strconv.Atoi(r.FormValue("offset"))
+		if err != nil || offset < 0 {
+			writeError(c, w, http.StatusBadRequest, "offset が正しくありません")
+			return
+		}
+	}
+	
+	if r.FormValue("season") != "" && writeStandings(c, w, r, limit, offset) {
+		return
+	}
+	if r.FormValue("friends") != "" {
+		writeFriendRanking(c, w, r, board, kind, limit, offset)
+		return
+	}
+	
+	query = datastore.NewQuery(kind).Order(sortOrder)
+	var cursor datastore.Cursor
+	position = offset
+	if r.FormValue("cursor") != "" {
+		position, cursor, err = decodeRankingCursor(r.FormValue("cursor"))
+		if err != nil {
+			writeError(c, w, http.StatusBadRequest, "cursor が正しくありません")
+			return
+		}
+	}
+	if cursor.String() != "" {
+		query = query.Start(cursor)
+	} else {
+		query = query.Offset(position)
+		
+		// 上位だけならキャッシュから応答する
+		if position <= topCacheSize - limit {
+			var top *TopCache
+			top, err = board.loadTop(c, kind)
+			check(c, err)
+			if err == nil && top.covers(position, limit) {
+				writeCachedRanking(c, w, r, board, top, limit, position)
+				return
+			}
+		}
+	}
+	
+	keys, entities, next, err = runRanking(c, query, limit, position)
 	check(c, err)
 	
-	query = datastore.NewQuery(kind).Limit(limit).Order("-Score")
-	count, err = query.Count(c)
+	if r.FormValue("format") != "envelope" {
+		showDisplayNames(c, entities)
+		writeJSON(c, w, entities)
+		return
+	}
+	
+	var page *RankingPage
+	page = new(RankingPage)
+	page.Cursor = next
+	page.Entries, err = board.rankEntries(c, kind, position + 1, keys, entities)
+	check(c, err)
+	err = board.attachChanges(c, kind, page.Entries)
 	check(c, err)
+	showDisplayNames(c, entities)
+	if r.FormValue("cursor") == "" {
+		var total int
+		total, err = datastore.NewQuery(kind).KeysOnly().Count(c)
+		check(c, err)
+		page.Total = &total
+	}
+	
+	writeJSON(c, w, page)
+}
+
+/**
+ * ランキングのクエリを limit 件まで実行する
+ * 続きがありそうなら次のページのカーソルも返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {*datastore.Query} query 並び順を指定したクエリ
+ * @param {int} limit 取得する件数
+ * @param {int} position 取得を始める位置（何件読み飛ばしたか）
+ * @returns {[]*datastore.Key} キーのリスト
+ * @returns {[]*Entity} ランキングデータのリスト
+ * @returns {string} 次のページのカーソル（最後まで読んだら空文字列）
+ * @returns {error} エラー
+ */
+func runRanking(c appengine.Context, query *datastore.Query, limit int, position int) ([]*datastore.Key, []*Entity, string, error) {
+	var iterator *datastore.Iterator
+	var keys []*datastore.Key
+	var entities []*Entity
+	var key *datastore.Key
+	var entity *Entity
+	var cursor datastore.Cursor
+	var err error
 	
-	iterator = query.Run(c)
+	keys = make([]*datastore.Key, 0)
 	entities = make([]*Entity, 0)
-	for i = 0; i < count; i++ {
+	iterator = query.Limit(limit).Run(c)
+	for {
 		entity = new(Entity)
-		_, err = iterator.Next(entity)
-		check(c, err)
+		key, err = iterator.Next(entity)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return keys, entities, "", err
+		}
+		keys = append(keys, key)
 		entities = append(entities, entity)
 	}
 	
-	result, err = json.Marshal(entities)
-	check(c, err)
+	if len(entities) < limit {
+		return keys, entities, "", nil
+	}
+	cursor, err = iterator.Cursor()
+	if err != nil {
+		return keys, entities, "", err
+	}
+	return keys, entities, encodeRankingCursor(position + len(entities), cursor), nil
+}
+
+/**
+ * 次のページのカーソルを作成する
+ * 順位を付けられるように datastore のカーソルに読み込み済みの件数を加える
+ * @function
+ * @param {int} position 読み込み済みの件数
+ * @param {datastore.Cursor} cursor datastore のカーソル
+ * @returns {string} クライアントへ返すカーソル
+ */
+func encodeRankingCursor(position int, cursor datastore.Cursor) string {
+	return strings.Join([]string{strconv.Itoa(position), cursor.String()}, ".")
+}
+
+/**
+ * クライアントから受け取ったカーソルを解析する
+ * キャッシュから応答したページのカーソルは datastore のカーソルを含まない（読み込み済みの件数だけで続きを取得する）
+ * @function
+ * @param {string} str encodeRankingCursor で作成したカーソル
+ * @returns {int} 読み込み済みの件数
+ * @returns {datastore.Cursor} datastore のカーソル
+ * @returns {error} エラー
+ */
+func decodeRankingCursor(str string) (int, datastore.Cursor, error) {
+	var parts []string
+	var position int
+	var cursor datastore.Cursor
+	var err error
 	
-	fmt.Fprintf(w, "%s", result)
+	parts = strings.SplitN(str, ".", 2)
+	if len(parts) != 2 {
+		return 0, cursor, errors.New("invalid cursor")
+	}
+	position, err = strconv.Atoi(parts[0])
+	if err != nil || position < 0 {
+		return 0, cursor, errors.New("invalid cursor")
+	}
+	if parts[1] == "" {
+		return position, cursor, nil
+	}
+	cursor, err = datastore.DecodeCursor(parts[1])
+	return position, cursor, err
+}
+
+/**
+ * putRanking の応答
+ * @member {string} Key 登録したエンティティのキー
+ * @member {bool} Best 自己ベストを更新したかどうか（BestOnly のランキングのみ）
+ * @member {bool} Pending 承認待ちになったかどうか（true なら Key は承認待ちの送信のキー）
+ */
+type PutResult struct {
+	Key string
+	Best bool
+	Pending bool
 }
 
 /**
  * ランキングに登録する
+ * BestOnly のランキングではプレイヤー名をキーにして最高得点のみを保持する
+ * 得点の上下はランキングの設定の並び順に従う
+ * ランキングの検査ルールに違反した送信は記録して拒否する
+ * 外れ値と判定された送信は公開せずに承認待ちにする
+ * 出場停止中のプレイヤーからの送信は拒否する
+ * ランキングで宣言された追加項目は meta.項目名 で送信する
+ * リプレイは multipart/form-data の replay で送信する
+ * 順位の基準を宣言したランキングでは score.基準の名前 ですべての値を送信する
+ * 区分を宣言したランキングでは region=JP のように区分の値も送信できる
+ * player と token を送信するとプレイヤーとして登録する（name の代わりにプレイヤーIDで識別し、署名の name にもプレイヤーIDを使う）
+ * ランキングに秘密鍵が設定されていれば ts, nonce, sig による署名が必要（scoresign パッケージを参照）
  * @function
  */
 func putRanking(w http.ResponseWriter, r *http.Request) {
-	var kind string
 	var name string
 	var score int
 	var err error
 	var c appengine.Context
 	var key *datastore.Key
 	var entity *Entity
+	var board *Board
+	var result *PutResult
 	
 	c = appengine.NewContext(r)
 	
-	kind = r.FormValue("kind")
+	board = requestBoard(c, w, r)
+	if board == nil {
+		return
+	}
+	if board.isAggregate() {
+		writeError(c, w, http.StatusBadRequest, "集計ランキングには直接登録できません")
+		return
+	}
 	name = r.FormValue("name")
+	var player *Player
+	if r.FormValue("player") != "" {
+		player, err = authenticatePlayer(c, r.FormValue("player"), r.FormValue("token"))
+		if err == errBadToken {
+			writeError(c, w, http.StatusForbidden, err.Error())
+			return
+		}
+		check(c, err)
+		if err != nil {
+			writeError(c, w, http.StatusInternalServerError, "プレイヤーを読み込めませんでした")
+			return
+		}
+		name = player.ID
+	} else if isPlayerID(c, name) {
+		writeError(c, w, http.StatusForbidden, "プレイヤーIDを name に使うには player と token が必要です")
+		return
+	}
 	
 	score, err = strconv.Atoi(r.FormValue("score"))
-	check(c, err)
-	
-	key = datastore.NewIncompleteKey(c, kind, nil)
+	if err != nil {
+		writeError(c, w, http.StatusBadRequest, "score が正しくありません")
+		return
+	}
 	
 	entity = new(Entity)
 	entity.Name = name
 	entity.Score = score
+	entity.Created = time.Now()
+	if player != nil {
+		entity.Player = player.ID
+	}
+	entity.Values, err = board.requestValues(r, true)
+	if err != nil {
+		writeError(c, w, http.StatusBadRequest, err.Error())
+		return
+	}
+	err = board.verifySignature(c, r, name, score, entity.Values)
+	if err != nil {
+		writeError(c, w, http.StatusForbidden, err.Error())
+		return
+	}
+	entity.Meta, err = board.requestMetadata(r)
+	if err != nil {
+		writeError(c, w, http.StatusBadRequest, err.Error())
+		return
+	}
+	entity.Partitions, err = board.requestPartitions(r)
+	if err != nil {
+		writeError(c, w, http.StatusBadRequest, err.Error())
+		return
+	}
+	
+	if board.BestOnly && name == "" {
+		writeError(c, w, http.StatusBadRequest, "name が指定されていません")
+		return
+	}
+	if isBanned(c, name) {
+		writeError(c, w, http.StatusForbidden, "このプレイヤーは出場停止中です")
+		return
+	}
+	var rejection *Rejection
+	rejection = board.validate(c, entity)
+	if rejection != nil {
+		board.reject(c, w, r, rejection)
+		return
+	}
+	var replay *Replay
+	replay, err = board.requestReplay(r)
+	if err != nil {
+		writeError(c, w, http.StatusBadRequest, err.Error())
+		return
+	}
+	
+	result = new(PutResult)
+	var reason string
+	reason = board.suspicious(c, entity)
+	if reason != "" {
+		result.Pending = true
+		key, err = board.hold(c, entity, reason)
+	} else {
+		key, result.Best, err = storeScore(c, board, entity)
+	}
+	check(c, err)
+	if err != nil {
+		writeError(c, w, http.StatusInternalServerError, "登録に失敗しました")
+		return
+	}
+	
+	// BestOnly のランキングで自己ベストを更新しなかった場合はリプレイを捨てる
+	if replay != nil && (!board.BestOnly || result.Best || result.Pending) {
+		err = saveReplay(c, replay, key, entity)
+		check(c, err)
+	}
+	// リプレイなしで自己ベストを更新したら、前の記録のリプレイは別の得点のものになるので削除する
+	if replay == nil && board.BestOnly && result.Best {
+		err = datastore.Delete(c, replayKey(c, key))
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			check(c, err)
+		}
+	}
+	
+	result.Key = key.Encode()
+	writeJSON(c, w, result)
+}
+
+/**
+ * ランキングと期間別ランキングにデータを書き込む
+ * 通常のランキングに書き込んだときは、このランキングを集計元にしている集計ランキングも更新する
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {*Board} board ランキングの設定
+ * @param {*Entity} entity 登録するデータ
+ * @returns {*datastore.Key} 通常のランキングに書き込んだエンティティのキー
+ * @returns {bool} 通常のランキングで自己ベストを更新したかどうか（BestOnly のランキングのみ）
+ * @returns {error} エラー
+ */
+func storeScore(c appengine.Context, board *Board, entity *Entity) (*datastore.Key, bool, error) {
+	var kinds []string
+	var keys []*datastore.Key
+	var entities []*Entity
+	var best bool
+	var i int
+	var err error
+	
+	entity.SortKey = board.sortKey(entity)
+	kinds = board.targetKinds(c, entity)
+	keys = make([]*datastore.Key, len(kinds))
+	if board.BestOnly {
+		// 期間別ランキングでもそれぞれの期間の最高得点を保持する
+		for i = len(kinds) - 1; i >= 0; i-- {
+			keys[i], best, err = putBestScore(c, board, kinds[i], entity)
+			if err != nil {
+				return nil, false, err
+			}
+		}
+		if best {
+			check(c, board.refreshAggregates(c, entity.Name, entity))
+		}
+		return keys[0], best, nil
+	}
 	
-	_, err = datastore.Put(c, key, entity)
+	entities = make([]*Entity, len(kinds))
+	for i = 0; i < len(kinds); i++ {
+		keys[i] = datastore.NewIncompleteKey(c, kinds[i], nil)
+		entities[i] = entity
+	}
+	keys, err = datastore.PutMulti(c, keys, entities)
+	if err != nil {
+		return nil, false, err
+	}
+	for i = 0; i < len(kinds); i++ {
+		check(c, board.updateStats(c, kinds[i], []*Entity{entity}, nil))
+		board.patchTop(c, kinds[i], keys[i], entity, false)
+	}
+	check(c, board.refreshAggregates(c, entity.Name, entity))
+	return keys[0], false, nil
+}
+
+/**
+ * プレイヤーの最高得点を更新する
+ * 保存済みの得点より上位の場合のみ上書きする（同じ順位なら先に登録した方を残す）
+ * 同時に投稿されても上位の方が残るようにトランザクション内で比較する
+ * 更新したときは得点の統計も入れ替える
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {*Board} board ランキングの設定
+ * @param {string} kind ランキングの種類
+ * @param {*Entity} entity 登録するデータ
+ * @returns {*datastore.Key} プレイヤーのエンティティのキー
+ * @returns {bool} 自己ベストを更新したかどうか
+ * @returns {error} エラー
+ */
+func putBestScore(c appengine.Context, board *Board, kind string, entity *Entity) (*datastore.Key, bool, error) {
+	var key *datastore.Key
+	var best bool
+	var replaced []*Entity
+	var err error
+	
+	key = datastore.NewKey(c, kind, entity.Name, 0, nil)
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var stored *Entity
+		var err error
+		
+		best = false
+		replaced = nil
+		stored = new(Entity)
+		err = datastore.Get(c, key, stored)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if err == nil && !board.better(entity, stored) {
+			return nil
+		}
+		if err == nil {
+			replaced = []*Entity{stored}
+		}
+		
+		_, err = datastore.Put(c, key, entity)
+		if err != nil {
+			return err
+		}
+		best = true
+		return nil
+	}, nil)
+	if err == nil && best {
+		check(c, board.updateStats(c, kind, []*Entity{entity}, replaced))
+		board.patchTop(c, kind, key, entity, len(replaced) > 0)
+	}
+	
+	return key, best, err
+}
+
+/**
+ * 値を JSON にして出力する
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {http.ResponseWriter} w 応答先
+ * @param {interface{}} v 出力する値
+ */
+func writeJSON(c appengine.Context, w http.ResponseWriter, v interface{}) {
+	writeJSONStatus(c, w, http.StatusOK, v)
+}
+
+/**
+ * HTTPステータスコードを指定して値を JSON にして出力する
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {http.ResponseWriter} w 応答先
+ * @param {int} status HTTPステータスコード
+ * @param {interface{}} v 出力する値
+ */
+func writeJSONStatus(c appengine.Context, w http.ResponseWriter, status int, v interface{}) {
+	var result []byte
+	var err error
+	
+	result, err = json.Marshal(v)
 	check(c, err)
+	
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s", result)
+}
+
+/**
+ * エラーを JSON にして出力する
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {http.ResponseWriter} w 応答先
+ * @param {int} status HTTPステータスコード
+ * @param {string} message エラーメッセージ
+ */
+func writeError(c appengine.Context, w http.ResponseWriter, status int, message string) {
+	writeJSONStatus(c, w, status, map[string]string{"Error": message})
 }
 
 /**
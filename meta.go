@@ -0,0 +1,196 @@
+package okanoworld
+
+import(
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+/**
+ * 1つのランキングに宣言できる追加項目の数
+ */
+const maxFields = 10
+
+/**
+ * 文字列の追加項目の長さの初期値
+ */
+const defaultFieldLength = 32
+
+/**
+ * ランキングデータに付ける追加項目（ステージ、キャラクター、プレイ時間など）
+ * putRanking で受け取った値を JSON の文字列として保存し、JSON ではオブジェクトとして出力する
+ * @class
+ */
+type Metadata string
+
+/**
+ * 追加項目の宣言
+ * Board.Fields には "名前:型:最大長" の文字列で保存する（例: stage:int, character:string:16）
+ * @class
+ * @member {string} Name 項目名
+ * @member {string} Type 型（int, float, string）
+ * @member {int} Max 文字列の最大文字数
+ */
+type Field struct {
+	Name string
+	Type string
+	Max int
+}
+
+/**
+ * JSON にする
+ * 保存している JSON をそのまま出力する
+ * @method
+ * @memberof Metadata
+ * @returns {[]byte} JSON
+ * @returns {error} エラー
+ */
+func (this Metadata) MarshalJSON() ([]byte, error) {
+	if this == "" {
+		return []byte("null"), nil
+	}
+	return []byte(this), nil
+}
+
+/**
+ * 追加項目の宣言を解析する
+ * @function
+ * @param {string} str "名前:型:最大長" の文字列
+ * @returns {*Field} 追加項目の宣言
+ * @returns {error} 正しくなければエラー
+ */
+func parseField(str string) (*Field, error) {
+	var parts []string
+	var field *Field
+	var err error
+	
+	parts = strings.Split(str, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+		return nil, errors.New("追加項目は 名前:型:最大長 で指定してください: " + str)
+	}
+	
+	field = new(Field)
+	field.Name = parts[0]
+	field.Type = parts[1]
+	switch field.Type {
+	case "int", "float":
+	case "string":
+		field.Max = defaultFieldLength
+		if len(parts) == 3 {
+			field.Max, err = strconv.Atoi(parts[2])
+			if err != nil || field.Max <= 0 {
+				return nil, errors.New("追加項目の最大長が正しくありません: " + str)
+			}
+		}
+	default:
+		return nil, errors.New("追加項目の型は int, float, string のいずれかです: " + str)
+	}
+	return field, nil
+}
+
+/**
+ * 追加項目の宣言の一覧を解析する
+ * @function
+ * @param {string} str カンマ区切りの宣言
+ * @returns {[]string} Board.Fields に保存する宣言
+ * @returns {error} 正しくなければエラー
+ */
+func parseFields(str string) ([]string, error) {
+	var specs []string
+	var names map[string]bool
+	var field *Field
+	var i int
+	var err error
+	
+	if str == "" {
+		return []string{}, nil
+	}
+	specs = strings.Split(str, ",")
+	if len(specs) > maxFields {
+		return nil, errors.New("追加項目が多すぎます")
+	}
+	names = make(map[string]bool)
+	for i = 0; i < len(specs); i++ {
+		field, err = parseField(specs[i])
+		if err != nil {
+			return nil, err
+		}
+		if names[field.Name] {
+			return nil, errors.New("追加項目の名前が重複しています: " + field.Name)
+		}
+		names[field.Name] = true
+	}
+	return specs, nil
+}
+
+/**
+ * リクエストから追加項目を読み取る
+ * 追加項目は meta.項目名 で送信する
+ * 宣言されていない項目や型の合わない値はエラーにする
+ * @method
+ * @memberof Board
+ * @param {*http.Request} r リクエスト
+ * @returns {Metadata} 追加項目（なければ空文字列）
+ * @returns {error} 正しくなければエラー
+ */
+func (this *Board) requestMetadata(r *http.Request) (Metadata, error) {
+	var values map[string]interface{}
+	var fields map[string]*Field
+	var field *Field
+	var name string
+	var value string
+	var result []byte
+	var i int
+	var err error
+	
+	fields = make(map[string]*Field)
+	for i = 0; i < len(this.Fields); i++ {
+		field, err = parseField(this.Fields[i])
+		if err != nil {
+			return "", err
+		}
+		fields[field.Name] = field
+	}
+	
+	values = make(map[string]interface{})
+	for name = range r.Form {
+		if !strings.HasPrefix(name, "meta.") {
+			continue
+		}
+		field = fields[strings.TrimPrefix(name, "meta.")]
+		if field == nil {
+			return "", errors.New("宣言されていない追加項目です: " + name)
+		}
+		value = r.Form.Get(name)
+		switch field.Type {
+		case "int":
+			values[field.Name], err = strconv.ParseInt(value, 10, 64)
+		case "float":
+			var number float64
+			number, err = strconv.ParseFloat(value, 64)
+			// NaN や Inf は JSON にできない
+			if err == nil && (math.IsNaN(number) || math.IsInf(number, 0)) {
+				err = errors.New("not finite")
+			}
+			values[field.Name] = number
+		case "string":
+			if utf8.RuneCountInString(value) > field.Max {
+				err = errors.New("too long")
+			}
+			values[field.Name] = value
+		}
+		if err != nil {
+			return "", errors.New("追加項目の値が正しくありません: " + name)
+		}
+	}
+	
+	if len(values) == 0 {
+		return "", nil
+	}
+	result, err = json.Marshal(values)
+	return Metadata(result), err
+}
@@ -0,0 +1,270 @@
+package okanoworld
+
+import(
+	"fmt"
+	"net/http"
+	"time"
+	"appengine"
+	"appengine/datastore"
+)
+
+/**
+ * 承認待ちの送信
+ * 外れ値と判定された送信はランキングに公開せずにここへ保存する
+ * datastore には kind "Pending"、ランキングの設定のキーを親として保存する
+ * @class
+ * @member {Entity} Entry 送信されたランキングデータ
+ * @member {string} Reason 承認待ちにした理由
+ */
+type Pending struct {
+	Entry Entity
+	Reason string
+}
+
+/**
+ * getPending の応答に含める承認待ちの送信
+ * @member {string} Key 承認や却下に使うキー
+ */
+type PendingEntry struct {
+	Key string
+	*Pending
+}
+
+/**
+ * 得点が外れ値かどうかを判定する
+ * 現在の1位やプレイヤー自身の最高得点と比べて、
+ * ランキングに設定された倍率を超えて上回っていれば外れ値とする
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @param {*Entity} entity 登録するデータ
+ * @returns {string} 外れ値ならその理由、そうでなければ空文字列
+ */
+func (this *Board) suspicious(c appengine.Context, entity *Entity) string {
+	var top []*Entity
+	var previous *Entity
+	var err error
+	
+	if this.OutlierFactor > 0 {
+		_, err = datastore.NewQuery(this.ID).Order(sortOrder).Limit(1).GetAll(c, &top)
+		check(c, err)
+		if len(top) > 0 && this.beyond(entity.Score, top[0].Score, this.OutlierFactor) {
+			return "現在の1位を大きく上回っています"
+		}
+	}
+	
+	if this.PlayerOutlierFactor > 0 && entity.Name != "" {
+		_, previous, err = findEntry(c, this, this.ID, "", entity.Name)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			check(c, err)
+		}
+		if err == nil && this.beyond(entity.Score, previous.Score, this.PlayerOutlierFactor) {
+			return "自己ベストを大きく上回っています"
+		}
+	}
+	
+	return ""
+}
+
+/**
+ * 得点が基準の得点を倍率以上に上回っているかどうか
+ * 得点の低い方が上位のランキングでは基準の得点を倍率で割った値を下回っているかどうか
+ * 基準の得点が0以下のときは判定しない
+ * @method
+ * @memberof Board
+ * @param {int} score 得点
+ * @param {int} base 基準の得点
+ * @param {float64} factor 倍率
+ * @returns {bool} 上回っていれば true
+ */
+func (this *Board) beyond(score int, base int, factor float64) bool {
+	if base <= 0 {
+		return false
+	}
+	if this.Ascending {
+		return float64(score) < float64(base) / factor
+	}
+	return float64(score) > float64(base) * factor
+}
+
+/**
+ * 送信を承認待ちとして保存する
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @param {*Entity} entity 登録するデータ
+ * @param {string} reason 承認待ちにした理由
+ * @returns {*datastore.Key} 承認待ちの送信のキー
+ * @returns {error} エラー
+ */
+func (this *Board) hold(c appengine.Context, entity *Entity, reason string) (*datastore.Key, error) {
+	var pending *Pending
+	pending = new(Pending)
+	pending.Entry = *entity
+	pending.Reason = reason
+	c.Warningf("pending %s: %s %d (%s)", this.ID, entity.Name, entity.Score, reason)
+	return datastore.Put(c, datastore.NewIncompleteKey(c, "Pending", boardKey(c, this.ID)), pending)
+}
+
+/**
+ * 承認待ちの送信の一覧を取得する
+ * 管理者のみ実行できる
+ * /getpending?kind=xxxxxx
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func getPending(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var board *Board
+	var keys []*datastore.Key
+	var pendings []*Pending
+	var entries []*PendingEntry
+	var i int
+	var err error
+	
+	c = appengine.NewContext(r)
+	if !requireAdmin(c, w, r) {
+		return
+	}
+	board = requestBoard(c, w, r)
+	if board == nil {
+		return
+	}
+	
+	keys, err = datastore.NewQuery("Pending").Ancestor(boardKey(c, board.ID)).GetAll(c, &pendings)
+	check(c, err)
+	
+	entries = make([]*PendingEntry, len(pendings))
+	for i = 0; i < len(pendings); i++ {
+		entries[i] = new(PendingEntry)
+		entries[i].Key = keys[i].Encode()
+		entries[i].Pending = pendings[i]
+	}
+	
+	writeJSON(c, w, entries)
+}
+
+/**
+ * 承認待ちの送信を承認してランキングに公開する
+ * 管理者のみ実行できる
+ * /approvepending?key=xxxxxx
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func approvePending(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var key *datastore.Key
+	var pending *Pending
+	var board *Board
+	var result *PutResult
+	var entryKey *datastore.Key
+	var err error
+	
+	c = appengine.NewContext(r)
+	if !requireAdmin(c, w, r) {
+		return
+	}
+	
+	key, pending = loadPending(c, w, r)
+	if pending == nil {
+		return
+	}
+	board, err = loadBoard(c, key.Parent().StringID())
+	check(c, err)
+	if err != nil {
+		writeError(c, w, http.StatusNotFound, "ランキングが見つかりません")
+		return
+	}
+	if isBanned(c, pending.Entry.Name) {
+		writeError(c, w, http.StatusForbidden, "このプレイヤーは出場停止中です")
+		return
+	}
+	
+	result = new(PutResult)
+	entryKey, result.Best, err = storeScore(c, board, &pending.Entry)
+	check(c, err)
+	if err != nil {
+		writeError(c, w, http.StatusInternalServerError, "登録に失敗しました")
+		return
+	}
+	err = moveReplay(c, key, entryKey, &pending.Entry)
+	check(c, err)
+	err = datastore.Delete(c, key)
+	check(c, err)
+	audit(c, "approvepending", board.ID, r.FormValue("key"), fmt.Sprintf("%s %d", pending.Entry.Name, pending.Entry.Score))
+	
+	result.Key = entryKey.Encode()
+	writeJSON(c, w, result)
+}
+
+/**
+ * 承認待ちの送信を却下する
+ * 却下した送信は Rejection として記録する
+ * 管理者のみ実行できる
+ * /rejectpending?key=xxxxxx
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func rejectPending(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var key *datastore.Key
+	var pending *Pending
+	var rejection *Rejection
+	var err error
+	
+	c = appengine.NewContext(r)
+	if !requireAdmin(c, w, r) {
+		return
+	}
+	
+	key, pending = loadPending(c, w, r)
+	if pending == nil {
+		return
+	}
+	
+	rejection = newRejection(&pending.Entry, "score", "moderation", pending.Reason)
+	rejection.Created = time.Now()
+	_, err = datastore.Put(c, datastore.NewIncompleteKey(c, "Rejection", key.Parent()), rejection)
+	check(c, err)
+	err = datastore.Delete(c, key)
+	check(c, err)
+	err = datastore.Delete(c, replayKey(c, key))
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		check(c, err)
+	}
+	audit(c, "rejectpending", key.Parent().StringID(), r.FormValue("key"), fmt.Sprintf("%s %d", pending.Entry.Name, pending.Entry.Score))
+	
+	writeJSON(c, w, rejection)
+}
+
+/**
+ * リクエストの key で指定された承認待ちの送信を取得する
+ * 取得できなければエラーを応答して nil を返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @returns {*datastore.Key} 承認待ちの送信のキー
+ * @returns {*Pending} 承認待ちの送信
+ */
+func loadPending(c appengine.Context, w http.ResponseWriter, r *http.Request) (*datastore.Key, *Pending) {
+	var key *datastore.Key
+	var pending *Pending
+	var err error
+	
+	key, err = datastore.DecodeKey(r.FormValue("key"))
+	if err != nil || key.Kind() != "Pending" {
+		writeError(c, w, http.StatusBadRequest, "key が正しくありません")
+		return nil, nil
+	}
+	pending = new(Pending)
+	err = datastore.Get(c, key, pending)
+	if err != nil {
+		writeError(c, w, http.StatusNotFound, "承認待ちの送信が見つかりません")
+		return nil, nil
+	}
+	return key, pending
+}
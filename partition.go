@@ -0,0 +1,197 @@
+package okanoworld
+
+import(
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+/**
+ * 1つのランキングに宣言できる区分の数
+ */
+const maxPartitions = 5
+
+/**
+ * 1つの区分に宣言できる値の数
+ */
+const maxPartitionValues = 50
+
+/**
+ * 区分の値とシーズンの id に使える文字
+ * kind 名の一部になるので @ や : は使えない
+ */
+var partitionPattern = regexp.MustCompile("^[A-Za-z0-9_.-]{1,32}$")
+
+/**
+ * 区分の名前に使える文字
+ * meta.項目名 や score.基準の名前 のパラメータと区別できるように . も使えない
+ */
+var partitionNamePattern = regexp.MustCompile("^[A-Za-z0-9_-]{1,32}$")
+
+/**
+ * 区分の名前に使えないリクエストのパラメータ名
+ * 期間（day, week, month）、season、archive は kind 名の接頭辞にも使うので、区分の名前にすると別の kind と同じ名前になってしまう
+ */
+var reservedParams = []string{"kind", "name", "score", "key", "period", "date", "season", "archive", "day", "week", "month", "cursor", "limit", "offset", "format", "range", "ts", "nonce", "sig", "replay", "percentiles", "buckets", "friends", "friend", "player", "token", "back"}
+
+/**
+ * 区分別ランキングを保存する kind 名を返す
+ * 通常のランキングの kind 名の後ろに区分の名前と値を付けたものになる
+ * 例: score@region:JP, score@platform:ios
+ * 期間別ランキングは区分別ランキングの kind 名に期間を付ける（例: score@region:JP@week:2013-W22）
+ * @function
+ * @param {string} kind ランキングの種類
+ * @param {string} partition "名前:値" の区分
+ * @returns {string} 区分別ランキングの kind 名
+ */
+func partitionKind(kind string, partition string) string {
+	return strings.Join([]string{kind, "@", partition}, "")
+}
+
+/**
+ * 区分の宣言
+ * Board.Partitions には "名前=値|値|..." の文字列で保存する（例: region=JP|US|EU）
+ * 宣言していない値は受け付けないので、クライアントが新しい kind を作ることはできない
+ * @class
+ * @member {string} Name 区分の名前
+ * @member {[]string} Values 区分の値
+ */
+type Partition struct {
+	Name string
+	Values []string
+}
+
+/**
+ * 区分の宣言を1つ解析する
+ * @function
+ * @param {string} str "名前=値|値|..." の文字列
+ * @returns {*Partition} 区分の宣言
+ * @returns {error} 正しくなければエラー
+ */
+func parsePartition(str string) (*Partition, error) {
+	var parts []string
+	var partition *Partition
+	var seen map[string]bool
+	var i int
+	
+	parts = strings.SplitN(str, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, errors.New("区分は 名前=値|値 で指定してください: " + str)
+	}
+	partition = new(Partition)
+	partition.Name = parts[0]
+	partition.Values = strings.Split(parts[1], "|")
+	if !partitionNamePattern.MatchString(partition.Name) {
+		return nil, errors.New("区分の名前が正しくありません: " + partition.Name)
+	}
+	for i = 0; i < len(reservedParams); i++ {
+		if partition.Name == reservedParams[i] {
+			return nil, errors.New("区分の名前には使えません: " + partition.Name)
+		}
+	}
+	if len(partition.Values) > maxPartitionValues {
+		return nil, errors.New("区分の値が多すぎます: " + partition.Name)
+	}
+	seen = make(map[string]bool)
+	for i = 0; i < len(partition.Values); i++ {
+		if !partitionPattern.MatchString(partition.Values[i]) {
+			return nil, errors.New("区分の値が正しくありません: " + partition.Values[i])
+		}
+		if seen[partition.Values[i]] {
+			return nil, errors.New("区分の値が重複しています: " + partition.Values[i])
+		}
+		seen[partition.Values[i]] = true
+	}
+	return partition, nil
+}
+
+/**
+ * 区分の宣言の一覧を解析する
+ * @function
+ * @param {string} str カンマ区切りの宣言（例: region=JP|US|EU,platform=ios|android）
+ * @returns {[]string} Board.Partitions に保存する宣言
+ * @returns {error} 正しくなければエラー
+ */
+func parsePartitions(str string) ([]string, error) {
+	var specs []string
+	var names map[string]bool
+	var partition *Partition
+	var i int
+	var err error
+	
+	if str == "" {
+		return []string{}, nil
+	}
+	specs = strings.Split(str, ",")
+	if len(specs) > maxPartitions {
+		return nil, errors.New("区分が多すぎます")
+	}
+	names = make(map[string]bool)
+	for i = 0; i < len(specs); i++ {
+		partition, err = parsePartition(specs[i])
+		if err != nil {
+			return nil, err
+		}
+		if names[partition.Name] {
+			return nil, errors.New("区分の名前が重複しています: " + partition.Name)
+		}
+		names[partition.Name] = true
+	}
+	return specs, nil
+}
+
+/**
+ * ランキングの区分の宣言を返す
+ * putBoard で検査済みなので、解析できない宣言（値を宣言していない古い設定など）は読み飛ばす
+ * @method
+ * @memberof Board
+ * @returns {[]*Partition} 区分の宣言（宣言した順）
+ */
+func (this *Board) partitions() []*Partition {
+	var result []*Partition
+	var partition *Partition
+	var i int
+	var err error
+	
+	result = make([]*Partition, 0, len(this.Partitions))
+	for i = 0; i < len(this.Partitions); i++ {
+		partition, err = parsePartition(this.Partitions[i])
+		if err != nil {
+			continue
+		}
+		result = append(result, partition)
+	}
+	return result
+}
+
+/**
+ * リクエストから区分を読み取る
+ * 宣言した区分の名前をパラメータ名にして送信する（例: region=JP&platform=ios）
+ * 宣言していない値はエラーにする
+ * @method
+ * @memberof Board
+ * @param {*http.Request} r リクエスト
+ * @returns {[]string} "名前:値" の区分のリスト（送信されなかった区分は含まない）
+ * @returns {error} 正しくなければエラー
+ */
+func (this *Board) requestPartitions(r *http.Request) ([]string, error) {
+	var partitions []*Partition
+	var result []string
+	var value string
+	var i int
+	
+	partitions = this.partitions()
+	result = make([]string, 0, len(partitions))
+	for i = 0; i < len(partitions); i++ {
+		value = r.FormValue(partitions[i].Name)
+		if value == "" {
+			continue
+		}
+		if !containsName(partitions[i].Values, value) {
+			return nil, errors.New(partitions[i].Name + " が正しくありません")
+		}
+		result = append(result, partitions[i].Name + ":" + value)
+	}
+	return result, nil
+}
@@ -0,0 +1,139 @@
+package okanoworld
+
+import(
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+/**
+ * parsePartition が "名前=値|値|..." を解析し、使えない名前や値を拒否すること
+ * @function
+ * @param {*testing.T} t テスト
+ */
+func TestParsePartition(t *testing.T) {
+	var tests []struct {
+		str string
+		partition *Partition
+	}
+	var partition *Partition
+	var err error
+	var i int
+	
+	tests = []struct {
+		str string
+		partition *Partition
+	}{
+		{"region=JP|US|EU", &Partition{"region", []string{"JP", "US", "EU"}}},
+		{"platform=ios", &Partition{"platform", []string{"ios"}}},
+		{"build=1.2.3|1.2_4", &Partition{"build", []string{"1.2.3", "1.2_4"}}},
+		{"region", nil},
+		{"region=", nil},
+		{"=JP", nil},
+		{"re.gion=JP", nil},
+		{"week=JP", nil},
+		{"season=JP", nil},
+		{"kind=JP", nil},
+		{"region=J:P", nil},
+		{"region=J@P", nil},
+		{"region=JP||US", nil},
+		{"region=JP|JP", nil},
+		{"region=0123456789012345678901234567890123", nil},
+	}
+	for i = 0; i < len(tests); i++ {
+		partition, err = parsePartition(tests[i].str)
+		if tests[i].partition == nil {
+			if err == nil {
+				t.Errorf("parsePartition(%q) succeeded, want error", tests[i].str)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(partition, tests[i].partition) {
+			t.Errorf("parsePartition(%q) = %v, %v, want %v", tests[i].str, partition, err, tests[i].partition)
+		}
+	}
+}
+
+/**
+ * parsePartitions が数と名前の重複を検査すること
+ * @function
+ * @param {*testing.T} t テスト
+ */
+func TestParsePartitions(t *testing.T) {
+	var tests []struct {
+		str string
+		specs []string
+		ok bool
+	}
+	var specs []string
+	var err error
+	var i int
+	
+	tests = []struct {
+		str string
+		specs []string
+		ok bool
+	}{
+		{"", []string{}, true},
+		{"region=JP|US", []string{"region=JP|US"}, true},
+		{"region=JP|US,platform=ios|android", []string{"region=JP|US", "platform=ios|android"}, true},
+		{"a=1,b=1,c=1,d=1,e=1", []string{"a=1", "b=1", "c=1", "d=1", "e=1"}, true},
+		{"a=1,b=1,c=1,d=1,e=1,f=1", nil, false},
+		{"region=JP,region=US", nil, false},
+		{"region=JP,", nil, false},
+	}
+	for i = 0; i < len(tests); i++ {
+		specs, err = parsePartitions(tests[i].str)
+		if (err == nil) != tests[i].ok {
+			t.Errorf("parsePartitions(%q) error = %v, want ok = %v", tests[i].str, err, tests[i].ok)
+			continue
+		}
+		if tests[i].ok && !reflect.DeepEqual(specs, tests[i].specs) {
+			t.Errorf("parsePartitions(%q) = %v, want %v", tests[i].str, specs, tests[i].specs)
+		}
+	}
+}
+
+/**
+ * requestPartitions が宣言した値だけを受け付けること
+ * @function
+ * @param {*testing.T} t テスト
+ */
+func TestRequestPartitions(t *testing.T) {
+	var tests []struct {
+		query string
+		partitions []string
+		ok bool
+	}
+	var board *Board
+	var partitions []string
+	var err error
+	var i int
+	
+	board = &Board{Partitions: []string{"region=JP|US", "platform=ios|android"}}
+	tests = []struct {
+		query string
+		partitions []string
+		ok bool
+	}{
+		{"", []string{}, true},
+		{"region=JP", []string{"region:JP"}, true},
+		{"platform=ios&region=US", []string{"region:US", "platform:ios"}, true},
+		{"region=EU", nil, false},
+		{"region=jp", nil, false},
+		{"platform=ios&region=EU", nil, false},
+	}
+	for i = 0; i < len(tests); i++ {
+		partitions, err = board.requestPartitions(&http.Request{Form: parseTestQuery(tests[i].query)})
+		if (err == nil) != tests[i].ok {
+			t.Errorf("requestPartitions(%q) error = %v, want ok = %v", tests[i].query, err, tests[i].ok)
+			continue
+		}
+		if tests[i].ok && !reflect.DeepEqual(partitions, tests[i].partitions) {
+			t.Errorf("requestPartitions(%q) = %v, want %v", tests[i].query, partitions, tests[i].partitions)
+		}
+	}
+	if partitionKind("score", "region:JP") != "score@region:JP" {
+		t.Errorf("partitionKind = %s, want score@region:JP", partitionKind("score", "region:JP"))
+	}
+}
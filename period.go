@@ -0,0 +1,240 @@
+package okanoworld
+
+import(
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"appengine"
+	"appengine/datastore"
+)
+
+/**
+ * 期間別ランキングの種類
+ * day は1日、week は月曜始まりの1週間（ISO週）、month は1か月
+ */
+var periods = []string{"day", "week", "month"}
+
+/**
+ * 期間の指定に使う日付の書式
+ */
+const dateLayout = "2006-01-02"
+
+/**
+ * 時差の初期値（日本時間）
+ */
+const defaultTimeZone = "Asia/Tokyo"
+
+/**
+ * 期間別ランキングを保存する kind 名を返す
+ * 通常のランキングの kind 名の後ろに期間を付けたものになる
+ * 例: score@day:2013-06-01, score@week:2013-W22, score@month:2013-06
+ * @function
+ * @param {string} kind ランキングの種類
+ * @param {string} period 期間の種類
+ * @param {time.Time} t 期間に含まれる時刻（ランキングの時差に合わせておく）
+ * @returns {string} 期間別ランキングの kind 名
+ */
+func periodKind(kind string, period string, t time.Time) string {
+	var name string
+	var year, week int
+	
+	switch period {
+	case "day":
+		name = t.Format(dateLayout)
+	case "week":
+		year, week = t.ISOWeek()
+		name = fmt.Sprintf("%04d-W%02d", year, week)
+	case "month":
+		name = t.Format("2006-01")
+	}
+	return strings.Join([]string{kind, "@", period, ":", name}, "")
+}
+
+/**
+ * ランキングの時差を返す
+ * 読み込めなければ UTC を返す
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @returns {*time.Location} ランキングの時差
+ */
+func (this *Board) location(c appengine.Context) *time.Location {
+	var name string
+	var location *time.Location
+	var err error
+	
+	name = this.TimeZone
+	if name == "" {
+		name = defaultTimeZone
+	}
+	location, err = time.LoadLocation(name)
+	check(c, err)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+/**
+ * 期間別ランキングを保存しているかどうか
+ * @method
+ * @memberof Board
+ * @param {string} period 期間の種類
+ * @returns {bool} 保存していれば true
+ */
+func (this *Board) hasPeriod(period string) bool {
+	var i int
+	for i = 0; i < len(this.Periods); i++ {
+		if this.Periods[i] == period {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * 登録するデータを書き込む kind 名のリストを返す
+ * 通常のランキングに加えて、保存している期間別ランキングと開催中のシーズンの kind 名が含まれる
+ * 区分が送信されていれば、区分別ランキングとその期間別ランキングの kind 名も含まれる
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @param {*Entity} entity 登録するデータ
+ * @returns {[]string} kind 名のリスト
+ */
+func (this *Board) targetKinds(c appengine.Context, entity *Entity) []string {
+	var kinds []string
+	var t time.Time
+	var seasons []string
+	var i int
+	
+	kinds = []string{this.ID}
+	t = entity.Created.In(this.location(c))
+	for i = 0; i < len(this.Periods); i++ {
+		kinds = append(kinds, periodKind(this.ID, this.Periods[i], t))
+	}
+	for i = 0; i < len(entity.Partitions); i++ {
+		var base string
+		var j int
+		base = partitionKind(this.ID, entity.Partitions[i])
+		kinds = append(kinds, base)
+		for j = 0; j < len(this.Periods); j++ {
+			kinds = append(kinds, periodKind(base, this.Periods[j], t))
+		}
+	}
+	seasons = activeSeasons(c, this.ID, entity.Created)
+	for i = 0; i < len(seasons); i++ {
+		kinds = append(kinds, seasonKind(this.ID, seasons[i]))
+	}
+	return kinds
+}
+
+/**
+ * リクエストで指定されたランキングの kind 名を返す
+ * period を指定すると現在の期間の、さらに date を指定するとその日を含む期間のランキングになる
+ * season を指定するとそのシーズンの、archive を指定すると wipeBoard で保存したアーカイブのランキングになる
+ * 区分の名前と値を1つ指定すると区分別ランキングになり、period や date と組み合わせられる
+ * /getranking?kind=xxxxxx&period=week&date=2013-06-01
+ * /getranking?kind=xxxxxx&region=JP&period=week
+ * /getranking?kind=xxxxxx&season=xxxxxx
+ * /getranking?kind=xxxxxx&archive=xxxxxx
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @param {*http.Request} r リクエスト
+ * @returns {string} kind 名
+ * @returns {error} 期間の指定が正しくなければエラー
+ */
+func (this *Board) requestKind(c appengine.Context, r *http.Request) (string, error) {
+	var period string
+	var partitions []string
+	var base string
+	var location *time.Location
+	var t time.Time
+	var err error
+	
+	period = r.FormValue("period")
+	partitions, err = this.requestPartitions(r)
+	if err != nil {
+		return "", err
+	}
+	if len(partitions) > 1 {
+		return "", errors.New("区分は1つだけ指定できます")
+	}
+	if len(partitions) > 0 && (r.FormValue("archive") != "" || r.FormValue("season") != "") {
+		return "", errors.New("区分は archive や season と同時に指定できません")
+	}
+	base = this.ID
+	if len(partitions) > 0 {
+		base = partitionKind(this.ID, partitions[0])
+	}
+	if r.FormValue("archive") != "" {
+		if (period != "" && period != "all") || r.FormValue("season") != "" {
+			return "", errors.New("archive は period や season と同時に指定できません")
+		}
+		return archiveKind(this.ID, r.FormValue("archive")), nil
+	}
+	if r.FormValue("season") != "" {
+		if period != "" && period != "all" {
+			return "", errors.New("period と season は同時に指定できません")
+		}
+		err = datastore.Get(c, seasonKey(c, this.ID, r.FormValue("season")), new(Season))
+		if err != nil {
+			return "", errors.New("シーズンが見つかりません")
+		}
+		return seasonKind(this.ID, r.FormValue("season")), nil
+	}
+	if period == "" || period == "all" {
+		return base, nil
+	}
+	if !this.hasPeriod(period) {
+		return "", errors.New("このランキングでは指定された期間を集計していません")
+	}
+	
+	location = this.location(c)
+	if r.FormValue("date") == "" {
+		t = time.Now().In(location)
+	} else {
+		t, err = time.ParseInLocation(dateLayout, r.FormValue("date"), location)
+		if err != nil {
+			return "", errors.New("date は YYYY-MM-DD で指定してください")
+		}
+	}
+	return periodKind(base, period, t), nil
+}
+
+/**
+ * 期間の指定を解析する
+ * カンマ区切りの文字列から有効な期間だけを取り出す
+ * @function
+ * @param {string} str カンマ区切りの期間（例: day,week）
+ * @returns {[]string} 期間のリスト
+ * @returns {error} 無効な期間が含まれていればエラー
+ */
+func parsePeriods(str string) ([]string, error) {
+	var names []string
+	var result []string
+	var i, j int
+	var valid bool
+	
+	result = make([]string, 0, len(periods))
+	if str == "" {
+		return result, nil
+	}
+	names = strings.Split(str, ",")
+	for i = 0; i < len(names); i++ {
+		valid = false
+		for j = 0; j < len(periods); j++ {
+			if names[i] == periods[j] {
+				valid = true
+			}
+		}
+		if !valid {
+			return nil, errors.New("無効な期間です: " + names[i])
+		}
+		result = append(result, names[i])
+	}
+	return result, nil
+}
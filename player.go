@@ -0,0 +1,474 @@
+package okanoworld
+
+import(
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"regexp"
+	"time"
+	"unicode/utf8"
+	"appengine"
+	"appengine/datastore"
+)
+
+/**
+ * 表示名の最大文字数
+ */
+const maxDisplayName = 20
+
+/**
+ * アバターIDに使える文字
+ */
+var avatarPattern = regexp.MustCompile("^[A-Za-z0-9_-]{1,32}$")
+
+/**
+ * 国コード（ISO 3166-1 alpha-2）
+ */
+var countryPattern = regexp.MustCompile("^[A-Z]{2}$")
+
+/**
+ * プレイヤーID（randomHex(16) で作る）
+ */
+var playerIDPattern = regexp.MustCompile("^[0-9a-f]{32}$")
+
+/**
+ * プレイヤーの認証に失敗したときのエラー
+ */
+var errBadToken = errors.New("プレイヤーの認証に失敗しました")
+
+/**
+ * プレイヤー
+ * 端末ごとにサーバが発行する匿名のIDと秘密のトークンで識別する
+ * datastore には kind "Player"、プレイヤーIDをキー名として保存する
+ * プレイヤーとして送信したランキングデータは Name にプレイヤーIDを保存し、応答では現在の表示名に置き換える
+ * @class
+ * @member {string} ID プレイヤーID（キー名から復元する）
+ * @member {string} TokenHash トークンの SHA-256（トークンそのものは保存しない）
+ * @member {string} DisplayName 表示名
+ * @member {string} Avatar アバターID
+ * @member {string} Country 国コード
+ * @member {bool} Renamed 表示名を変更済みなら true（変更は1回だけ）
+ * @member {time.Time} Created 登録日時
+ */
+type Player struct {
+	ID string `datastore:"-"`
+	TokenHash string `json:"-"`
+	DisplayName string
+	Avatar string
+	Country string
+	Renamed bool
+	Created time.Time
+}
+
+/**
+ * registerPlayer の応答
+ * トークンはこの応答でしか返さないので、クライアントは端末に保存しておく
+ * @member {string} Token 秘密のトークン
+ */
+type Registration struct {
+	*Player
+	Token string
+}
+
+/**
+ * プレイヤーのキーを返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} id プレイヤーID
+ * @returns {*datastore.Key} キー
+ */
+func playerKey(c appengine.Context, id string) *datastore.Key {
+	return datastore.NewKey(c, "Player", id, 0, nil)
+}
+
+/**
+ * ランダムな16進数の文字列を作る
+ * @function
+ * @param {int} size バイト数
+ * @returns {string} 16進数の文字列
+ * @returns {error} エラー
+ */
+func randomHex(size int) (string, error) {
+	var bytes []byte
+	var err error
+	
+	bytes = make([]byte, size)
+	_, err = rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+/**
+ * トークンの SHA-256 を返す
+ * @function
+ * @param {string} token トークン
+ * @returns {string} 16進数の SHA-256
+ */
+func hashToken(token string) string {
+	var sum [sha256.Size]byte
+	sum = sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+/**
+ * プレイヤーを読み込む
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} id プレイヤーID
+ * @returns {*Player} プレイヤー
+ * @returns {error} 見つからなければ datastore.ErrNoSuchEntity
+ */
+func loadPlayer(c appengine.Context, id string) (*Player, error) {
+	var player *Player
+	var err error
+	
+	player = new(Player)
+	err = datastore.Get(c, playerKey(c, id), player)
+	if err != nil {
+		return nil, err
+	}
+	player.ID = id
+	return player, nil
+}
+
+/**
+ * 発行済みのプレイヤーIDかどうか
+ * プレイヤーとして送信したデータは Name にプレイヤーIDを保存するので、匿名の name にプレイヤーIDを使わせない
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} name プレイヤー名
+ * @returns {bool} 発行済みのプレイヤーIDなら true
+ */
+func isPlayerID(c appengine.Context, name string) bool {
+	var err error
+	
+	if !playerIDPattern.MatchString(name) {
+		return false
+	}
+	_, err = loadPlayer(c, name)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		// 確認できなければなりすましを防ぐ方に倒す
+		check(c, err)
+		return true
+	}
+	return err == nil
+}
+
+/**
+ * プレイヤーIDとトークンを確認する
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} id プレイヤーID
+ * @param {string} token トークン
+ * @returns {*Player} プレイヤー
+ * @returns {error} 認証に失敗すれば errBadToken
+ */
+func authenticatePlayer(c appengine.Context, id string, token string) (*Player, error) {
+	var player *Player
+	var err error
+	
+	if id == "" || token == "" {
+		return nil, errBadToken
+	}
+	player, err = loadPlayer(c, id)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, errBadToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(player.TokenHash), []byte(hashToken(token))) {
+		return nil, errBadToken
+	}
+	return player, nil
+}
+
+/**
+ * リクエストの player と token でプレイヤーを確認する
+ * 確認できなければエラーを出力する
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @returns {*Player} プレイヤー（エラーなら nil）
+ */
+func requestPlayer(c appengine.Context, w http.ResponseWriter, r *http.Request) *Player {
+	var player *Player
+	var err error
+	
+	player, err = authenticatePlayer(c, r.FormValue("player"), r.FormValue("token"))
+	if err == errBadToken {
+		writeError(c, w, http.StatusForbidden, err.Error())
+		return nil
+	}
+	check(c, err)
+	if err != nil {
+		writeError(c, w, http.StatusInternalServerError, "プレイヤーを読み込めませんでした")
+		return nil
+	}
+	return player
+}
+
+/**
+ * 表示名を検査する
+ * @function
+ * @param {string} name 表示名
+ * @returns {error} 正しくなければエラー
+ */
+func validateDisplayName(name string) error {
+	var length int
+	length = utf8.RuneCountInString(name)
+	if length == 0 || length > maxDisplayName {
+		return errors.New("name の長さが正しくありません")
+	}
+	return nil
+}
+
+/**
+ * プレイヤーを登録する
+ * 新しいプレイヤーIDとトークンを発行する
+ * name を指定すると最初の表示名になる（この設定は変更の回数に数えない）
+ * /registerplayer?name=xxxxxx
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func registerPlayer(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var player *Player
+	var result *Registration
+	var err error
+	
+	c = appengine.NewContext(r)
+	
+	player = new(Player)
+	player.DisplayName = r.FormValue("name")
+	if player.DisplayName != "" {
+		err = validateDisplayName(player.DisplayName)
+		if err != nil {
+			writeError(c, w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	player.Created = time.Now()
+	
+	result = new(Registration)
+	result.Player = player
+	player.ID, err = randomHex(16)
+	check(c, err)
+	if err == nil {
+		result.Token, err = randomHex(32)
+		check(c, err)
+	}
+	if err != nil {
+		writeError(c, w, http.StatusInternalServerError, "プレイヤーを登録できませんでした")
+		return
+	}
+	player.TokenHash = hashToken(result.Token)
+	
+	_, err = datastore.Put(c, playerKey(c, player.ID), player)
+	check(c, err)
+	if err != nil {
+		writeError(c, w, http.StatusInternalServerError, "プレイヤーを登録できませんでした")
+		return
+	}
+	
+	writeJSON(c, w, result)
+}
+
+/**
+ * プレイヤーのプロフィールを取得する
+ * /getplayer?id=xxxxxx
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func getPlayer(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var player *Player
+	var err error
+	
+	c = appengine.NewContext(r)
+	player, err = loadPlayer(c, r.FormValue("id"))
+	if err == datastore.ErrNoSuchEntity {
+		writeError(c, w, http.StatusNotFound, "プレイヤーが見つかりません")
+		return
+	}
+	check(c, err)
+	if err != nil {
+		writeError(c, w, http.StatusBadRequest, "id が正しくありません")
+		return
+	}
+	
+	writeJSON(c, w, player)
+}
+
+/**
+ * プレイヤーのプロフィールを更新する
+ * 指定した項目だけを更新する
+ * 表示名を付けた後に変更できるのは1回だけ
+ * /putprofile?id=xxxxxx&token=xxxxxx&name=xxxxxx&avatar=xxxxxx&country=JP
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func putProfile(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var player *Player
+	var id string
+	var err error
+	
+	c = appengine.NewContext(r)
+	id = r.FormValue("id")
+	_, err = authenticatePlayer(c, id, r.FormValue("token"))
+	if err == errBadToken {
+		writeError(c, w, http.StatusForbidden, err.Error())
+		return
+	}
+	check(c, err)
+	if err != nil {
+		writeError(c, w, http.StatusInternalServerError, "プレイヤーを読み込めませんでした")
+		return
+	}
+	
+	if r.FormValue("name") != "" {
+		err = validateDisplayName(r.FormValue("name"))
+		if err != nil {
+			writeError(c, w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if r.FormValue("avatar") != "" && !avatarPattern.MatchString(r.FormValue("avatar")) {
+		writeError(c, w, http.StatusBadRequest, "avatar が正しくありません")
+		return
+	}
+	if r.FormValue("country") != "" && !countryPattern.MatchString(r.FormValue("country")) {
+		writeError(c, w, http.StatusBadRequest, "country は2文字の国コードで指定してください")
+		return
+	}
+	
+	// 表示名の変更が1回を超えないようにトランザクション内で更新する
+	var renamedTwice bool
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var err error
+		
+		renamedTwice = false
+		player, err = loadPlayer(c, id)
+		if err != nil {
+			return err
+		}
+		if r.FormValue("name") != "" && r.FormValue("name") != player.DisplayName {
+			if player.Renamed {
+				renamedTwice = true
+				return nil
+			}
+			if player.DisplayName != "" {
+				player.Renamed = true
+			}
+			player.DisplayName = r.FormValue("name")
+		}
+		if r.FormValue("avatar") != "" {
+			player.Avatar = r.FormValue("avatar")
+		}
+		if r.FormValue("country") != "" {
+			player.Country = r.FormValue("country")
+		}
+		_, err = datastore.Put(c, playerKey(c, id), player)
+		return err
+	}, nil)
+	check(c, err)
+	if err != nil {
+		writeError(c, w, http.StatusInternalServerError, "プロフィールを更新できませんでした")
+		return
+	}
+	if renamedTwice {
+		writeError(c, w, http.StatusForbidden, "表示名の変更は1回だけです")
+		return
+	}
+	
+	writeJSON(c, w, player)
+}
+
+/**
+ * プレイヤーとして送信したランキングデータの Name を現在の表示名に置き換える
+ * 応答を出力する直前に呼び出す（datastore には書き戻さない）
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {[]*Entity} entities ランキングデータ
+ */
+func showDisplayNames(c appengine.Context, entities []*Entity) {
+	applyDisplayNames(entities, loadDisplayNames(c, entities))
+}
+
+/**
+ * プレイヤーとして送信したランキングデータのプレイヤーの表示名を読み込む
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {[]*Entity} entities ランキングデータ
+ * @returns {map[string]string} プレイヤーIDから表示名への対応（読み込めたプレイヤーはすべて入れ、表示名がなければ空文字列）
+ */
+func loadDisplayNames(c appengine.Context, entities []*Entity) map[string]string {
+	var keys []*datastore.Key
+	var ids []string
+	var players []*Player
+	var names map[string]string
+	var seen map[string]bool
+	var errs datastore.MultiError
+	var ok bool
+	var i int
+	var err error
+	
+	keys = make([]*datastore.Key, 0, len(entities))
+	ids = make([]string, 0, len(entities))
+	seen = make(map[string]bool)
+	for i = 0; i < len(entities); i++ {
+		if entities[i].Player == "" || seen[entities[i].Player] {
+			continue
+		}
+		seen[entities[i].Player] = true
+		ids = append(ids, entities[i].Player)
+		keys = append(keys, playerKey(c, entities[i].Player))
+	}
+	names = make(map[string]string)
+	if len(keys) == 0 {
+		return names
+	}
+	
+	players = make([]*Player, len(keys))
+	for i = 0; i < len(keys); i++ {
+		players[i] = new(Player)
+	}
+	err = datastore.GetMulti(c, keys, players)
+	errs, ok = err.(datastore.MultiError)
+	if err != nil && !ok {
+		check(c, err)
+		return names
+	}
+	for i = 0; i < len(keys); i++ {
+		if err != nil && errs[i] != nil {
+			continue
+		}
+		names[ids[i]] = players[i].DisplayName
+	}
+	return names
+}
+
+/**
+ * ランキングデータの Name を読み込んでおいた表示名に置き換える
+ * @function
+ * @param {[]*Entity} entities ランキングデータ
+ * @param {map[string]string} names プレイヤーIDから表示名への対応（loadDisplayNames の結果）
+ */
+func applyDisplayNames(entities []*Entity, names map[string]string) {
+	var i int
+	for i = 0; i < len(entities); i++ {
+		if entities[i].Player != "" && names[entities[i].Player] != "" {
+			entities[i].Name = names[entities[i].Player]
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package okanoworld
+
+import(
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"appengine"
+	"appengine/datastore"
+)
+
+/**
+ * pruneBoards で一度に削除するエンティティの件数
+ */
+const pruneBatchSize = 200
+
+/**
+ * pruneBoards の応答
+ * @member {map[string]int} Deleted kind ごとの削除した件数
+ * @member {int} Total 削除した件数の合計
+ * @member {bool} Done すべて削除し終わったかどうか（false ならもう一度呼び出す）
+ */
+type PruneResult struct {
+	Deleted map[string]int
+	Total int
+	Done bool
+}
+
+/**
+ * 保持する件数と期間の設定に従ってランキングのデータを削除する
+ * KeepTop だけなら上位 KeepTop 件より下を、RetentionDays があれば上位 KeepTop 件に入っていない古いデータを削除する
+ * シーズンとアーカイブは削除しない
+ * 一度に pruneBatchSize 件ずつ削除するので、Done が true になるまで繰り返し呼び出す
+ * kind を指定しなければ登録されているすべてのランキングが対象になる
+ * cron から定期的に呼び出す（管理者のみ実行できる）
+ * /pruneboards
+ * /pruneboards?kind=xxxxxx
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func pruneBoards(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var boards []*Board
+	var kinds []string
+	var result *PruneResult
+	var count int
+	var before int
+	var i, j int
+	var err error
+	
+	c = appengine.NewContext(r)
+	if !requireAdmin(c, w, r) {
+		return
+	}
+	if r.FormValue("kind") != "" {
+		var board *Board
+		board = requestBoard(c, w, r)
+		if board == nil {
+			return
+		}
+		boards = []*Board{board}
+	} else {
+		boards, err = loadBoards(c)
+		check(c, err)
+	}
+	
+	result = new(PruneResult)
+	result.Deleted = make(map[string]int)
+	for i = 0; i < len(boards) && result.Total < pruneBatchSize; i++ {
+		if boards[i].KeepTop <= 0 && boards[i].RetentionDays <= 0 {
+			continue
+		}
+		kinds, err = boards[i].kinds(c)
+		check(c, err)
+		before = result.Total
+		for j = 0; j < len(kinds) && result.Total < pruneBatchSize; j++ {
+			if strings.Contains(kinds[j], "@season:") || strings.Contains(kinds[j], "@archive:") {
+				continue
+			}
+			count, err = boards[i].prune(c, kinds[j], pruneBatchSize - result.Total)
+			check(c, err)
+			if count > 0 {
+				result.Deleted[kinds[j]] = count
+				result.Total += count
+			}
+		}
+		if result.Total > before {
+			audit(c, "pruneboards", boards[i].ID, "", fmt.Sprintf("%d件", result.Total - before))
+		}
+	}
+	result.Done = err == nil && result.Total < pruneBatchSize
+	
+	writeJSON(c, w, result)
+}
+
+/**
+ * kind から保持しないデータを limit 件まで削除する
+ * 得点の統計も更新し、通常のランキングから削除したプレイヤーは集計ランキングも集計し直す
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} kind kind 名
+ * @param {int} limit 削除する件数の上限
+ * @returns {int} 削除した件数
+ * @returns {error} エラー
+ */
+func (this *Board) prune(c appengine.Context, kind string, limit int) (int, error) {
+	var cutoff string
+	var query *datastore.Query
+	var iterator *datastore.Iterator
+	var keys []*datastore.Key
+	var entities []*Entity
+	var key *datastore.Key
+	var entity *Entity
+	var err error
+	
+	// 上位 KeepTop 件目の並び順のキー（これより後ろが上位から外れたデータ）
+	if this.KeepTop > 0 {
+		var top []*Entity
+		_, err = datastore.NewQuery(kind).Order(sortOrder).Offset(this.KeepTop - 1).Limit(1).GetAll(c, &top)
+		if err != nil {
+			return 0, err
+		}
+		if len(top) == 0 {
+			return 0, nil
+		}
+		cutoff = this.sortKey(top[0])
+	}
+	
+	if this.RetentionDays > 0 {
+		// kind ごとに複合インデックスを用意できないので日時だけで絞り込み、上位に入っているものは読み飛ばす
+		query = datastore.NewQuery(kind).Filter("Created <", time.Now().AddDate(0, 0, -this.RetentionDays))
+	} else {
+		query = datastore.NewQuery(kind).Filter("SortKey >", cutoff).Order(sortOrder).Limit(limit)
+	}
+	
+	iterator = query.Run(c)
+	for len(keys) < limit {
+		entity = new(Entity)
+		key, err = iterator.Next(entity)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if cutoff != "" && this.sortKey(entity) <= cutoff {
+			continue
+		}
+		keys = append(keys, key)
+		entities = append(entities, entity)
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	
+	err = datastore.DeleteMulti(c, keys)
+	if err != nil {
+		return 0, err
+	}
+	check(c, this.updateStats(c, kind, nil, entities))
+	invalidateTop(c, kind)
+	if kind == this.ID {
+		var names map[string]bool
+		var i int
+		names = make(map[string]bool)
+		for i = 0; i < len(entities); i++ {
+			if names[entities[i].Name] {
+				continue
+			}
+			names[entities[i].Name] = true
+			check(c, this.refreshAggregates(c, entities[i].Name, nil))
+		}
+	}
+	return len(keys), nil
+}
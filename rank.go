@@ -0,0 +1,322 @@
+package okanoworld
+
+import(
+	"net/http"
+	"strconv"
+	"appengine"
+	"appengine/datastore"
+)
+
+/**
+ * getRank の応答
+ * @member {string} Key エンティティのキー
+ * @member {string} Name プレイヤー名
+ * @member {int} Score 得点
+ * @member {int} Rank 順位（1位から）
+ * @member {int} Total ランキングの登録件数
+ * @member {int} PreviousRank 前回のスナップショットでの順位（入っていなければ0）
+ * @member {*int} Change 前回のスナップショットから上がった順位の数（入っていなければ省略）
+ */
+type RankResult struct {
+	Key string
+	Name string
+	Score int
+	Rank int
+	Total int
+	PreviousRank int `json:",omitempty"`
+	Change *int `json:",omitempty"`
+}
+
+/**
+ * プレイヤーの順位を取得する
+ * name か key のどちらかでプレイヤーを指定する
+ * exactRankLimit 位より下の順位は統計からの見積もり（countRank を参照）
+ * /getrank?kind=xxxxxx&name=xxxxxx
+ * /getrank?kind=xxxxxx&key=xxxxxx
+ * period と date で期間別ランキングでの順位を取得できる
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func getRank(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var kind string
+	var board *Board
+	var key *datastore.Key
+	var entity *Entity
+	var result *RankResult
+	var err error
+	
+	c = appengine.NewContext(r)
+	board = requestBoard(c, w, r)
+	if board == nil {
+		return
+	}
+	kind, err = board.requestKind(c, r)
+	if err != nil {
+		writeError(c, w, http.StatusBadRequest, err.Error())
+		return
+	}
+	
+	key, entity, err = findEntry(c, board, kind, r.FormValue("key"), r.FormValue("name"))
+	if err == datastore.ErrNoSuchEntity {
+		writeError(c, w, http.StatusNotFound, "プレイヤーが見つかりません")
+		return
+	}
+	check(c, err)
+	if err != nil {
+		writeError(c, w, http.StatusBadRequest, "プレイヤーの指定が正しくありません")
+		return
+	}
+	
+	result = new(RankResult)
+	result.Key = key.Encode()
+	result.Score = entity.Score
+	
+	result.Rank, err = board.countRank(c, kind, entity)
+	check(c, err)
+	
+	var ranked []*RankedEntity
+	ranked = []*RankedEntity{newRankedEntity(result.Rank, key, entity)}
+	err = board.attachChanges(c, kind, ranked)
+	check(c, err)
+	result.PreviousRank = ranked[0].PreviousRank
+	result.Change = ranked[0].Change
+	showDisplayNames(c, []*Entity{entity})
+	result.Name = entity.Name
+	
+	result.Total, err = datastore.NewQuery(kind).KeysOnly().Count(c)
+	check(c, err)
+	
+	writeJSON(c, w, result)
+}
+
+/**
+ * プレイヤーのエンティティを探す
+ * key が指定されていればそのエンティティを、
+ * name が指定されていればそのプレイヤーの最高得点のエンティティを返す
+ * 見つからなければ datastore.ErrNoSuchEntity を返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {*Board} board ランキングの設定
+ * @param {string} kind ランキングの種類
+ * @param {string} encodedKey putRanking が返したキー
+ * @param {string} name プレイヤー名
+ * @returns {*datastore.Key} 見つかったエンティティのキー
+ * @returns {*Entity} 見つかったエンティティ
+ * @returns {error} エラー
+ */
+func findEntry(c appengine.Context, board *Board, kind string, encodedKey string, name string) (*datastore.Key, *Entity, error) {
+	var key *datastore.Key
+	var entity *Entity
+	var err error
+	
+	if encodedKey != "" {
+		key, err = datastore.DecodeKey(encodedKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		if key.Kind() != kind {
+			return nil, nil, datastore.ErrNoSuchEntity
+		}
+		entity = new(Entity)
+		err = datastore.Get(c, key, entity)
+		return key, entity, err
+	}
+	
+	if name == "" {
+		return nil, nil, datastore.ErrNoSuchEntity
+	}
+	
+	if board.BestOnly {
+		key = datastore.NewKey(c, kind, name, 0, nil)
+		entity = new(Entity)
+		err = datastore.Get(c, key, entity)
+		return key, entity, err
+	}
+	
+	// kind ごとに複合インデックスを用意できないので名前だけで絞り込んで最高得点を探す
+	var keys []*datastore.Key
+	var entities []*Entity
+	var i int
+	keys, err = datastore.NewQuery(kind).Filter("Name =", name).GetAll(c, &entities)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(entities) == 0 {
+		return nil, nil, datastore.ErrNoSuchEntity
+	}
+	key = keys[0]
+	entity = entities[0]
+	for i = 1; i < len(entities); i++ {
+		if board.better(entities[i], entity) {
+			key = keys[i]
+			entity = entities[i]
+		}
+	}
+	return key, entity, nil
+}
+
+/**
+ * 順位付きのランキングデータ
+ * @member {int} Rank 順位（1位から）
+ * @member {string} Key エンティティのキー
+ * @member {int} PreviousRank 前回のスナップショットでの順位（入っていなければ0）
+ * @member {*int} Change 前回のスナップショットから上がった順位の数（入っていなければ省略）
+ */
+type RankedEntity struct {
+	Rank int
+	Key string
+	PreviousRank int `json:",omitempty"`
+	Change *int `json:",omitempty"`
+	*Entity
+}
+
+/**
+ * getNeighbors の応答
+ * @member {int} Rank 中心となるプレイヤー（または得点）の順位
+ * @member {[]*RankedEntity} Entries 中心の前後のランキングデータ
+ */
+type NeighborsResult struct {
+	Rank int
+	Entries []*RankedEntity
+}
+
+/**
+ * 指定したプレイヤーまたは得点の前後のランキングを取得する
+ * range で前後それぞれの件数を指定する（省略時は5件）
+ * /getneighbors?kind=xxxxxx&name=xxxxxx&range=5
+ * /getneighbors?kind=xxxxxx&key=xxxxxx
+ * /getneighbors?kind=xxxxxx&score=1000
+ * 順位の基準を宣言したランキングでは score.基準の名前 も指定できる（省略するとその得点の先頭が中心になる）
+ * period と date で期間別ランキングから取得できる
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func getNeighbors(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var kind string
+	var board *Board
+	var span int
+	var key *datastore.Key
+	var entity *Entity
+	var err error
+	
+	c = appengine.NewContext(r)
+	board = requestBoard(c, w, r)
+	if board == nil {
+		return
+	}
+	kind, err = board.requestKind(c, r)
+	if err != nil {
+		writeError(c, w, http.StatusBadRequest, err.Error())
+		return
+	}
+	
+	span = 5
+	if r.FormValue("range") != "" {
+		span, err = strconv.Atoi(r.FormValue("range"))
+		if err != nil || span < 0 || span > 50 {
+			writeError(c, w, http.StatusBadRequest, "range は0から50で指定してください")
+			return
+		}
+	}
+	
+	// 中心の並び順のキー
+	// プレイヤーを指定した場合はプレイヤー自身を、得点を指定した場合はその得点の先頭を中心にする
+	var center string
+	var result *NeighborsResult
+	result = new(NeighborsResult)
+	if r.FormValue("key") != "" || r.FormValue("name") != "" {
+		key, entity, err = findEntry(c, board, kind, r.FormValue("key"), r.FormValue("name"))
+		if err == datastore.ErrNoSuchEntity {
+			writeError(c, w, http.StatusNotFound, "プレイヤーが見つかりません")
+			return
+		}
+		check(c, err)
+		if err != nil {
+			writeError(c, w, http.StatusBadRequest, "プレイヤーの指定が正しくありません")
+			return
+		}
+		center = board.sortKey(entity)
+		result.Rank, err = board.countRank(c, kind, entity)
+		check(c, err)
+	} else {
+		var target *Entity
+		target = new(Entity)
+		target.Score, err = strconv.Atoi(r.FormValue("score"))
+		if err != nil {
+			writeError(c, w, http.StatusBadRequest, "name, key, score のいずれかを指定してください")
+			return
+		}
+		target.Values, err = board.requestValues(r, false)
+		if err != nil {
+			writeError(c, w, http.StatusBadRequest, err.Error())
+			return
+		}
+		center = board.rankKey(target)
+		result.Rank, err = board.countRank(c, kind, target)
+		check(c, err)
+	}
+	
+	var keys []*datastore.Key
+	var entities []*Entity
+	var position int
+	var i int
+	keys = make([]*datastore.Key, 0, span * 2 + 1)
+	entities = make([]*Entity, 0, span * 2 + 1)
+	
+	// 中心より上は下位から順に取得して逆順に並べ直す
+	var aboveKeys []*datastore.Key
+	var above []*Entity
+	aboveKeys, err = datastore.NewQuery(kind).Filter("SortKey <", center).Order(reverseSortOrder).Limit(span).GetAll(c, &above)
+	check(c, err)
+	for i = len(above) - 1; i >= 0; i-- {
+		keys = append(keys, aboveKeys[i])
+		entities = append(entities, above[i])
+	}
+	
+	// 中心と中心より下
+	var belowKeys []*datastore.Key
+	var below []*Entity
+	var query *datastore.Query
+	if entity != nil {
+		keys = append(keys, key)
+		entities = append(entities, entity)
+		query = datastore.NewQuery(kind).Filter("SortKey >", center)
+	} else {
+		query = datastore.NewQuery(kind).Filter("SortKey >=", center)
+	}
+	belowKeys, err = query.Order(sortOrder).Limit(span).GetAll(c, &below)
+	check(c, err)
+	keys = append(keys, belowKeys...)
+	entities = append(entities, below...)
+	
+	position, err = datastore.NewQuery(kind).Filter("SortKey <", center).KeysOnly().Count(c)
+	check(c, err)
+	result.Entries, err = board.rankEntries(c, kind, position - len(above) + 1, keys, entities)
+	check(c, err)
+	err = board.attachChanges(c, kind, result.Entries)
+	check(c, err)
+	showDisplayNames(c, entities)
+	
+	writeJSON(c, w, result)
+}
+
+/**
+ * RankedEntity を作成する
+ * @function
+ * @param {int} rank 順位
+ * @param {*datastore.Key} key エンティティのキー
+ * @param {*Entity} entity ランキングデータ
+ * @returns {*RankedEntity} 順位付きのランキングデータ
+ */
+func newRankedEntity(rank int, key *datastore.Key, entity *Entity) *RankedEntity {
+	var ranked *RankedEntity
+	ranked = new(RankedEntity)
+	ranked.Rank = rank
+	ranked.Key = key.Encode()
+	ranked.Entity = entity
+	return ranked
+}
@@ -0,0 +1,449 @@
+package okanoworld
+
+import(
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+	"appengine"
+	"appengine/datastore"
+)
+
+/**
+ * リプレイの最大サイズに設定できる上限
+ * datastore の1エンティティの上限より小さくしておく
+ */
+const maxReplayLimit = 900 * 1024
+
+/**
+ * リプレイを残す上位件数の初期値
+ */
+const defaultReplayTopN = 100
+
+/**
+ * pruneReplays で一度に確認して削除するリプレイの件数
+ */
+const replayBatchSize = 200
+
+/**
+ * スコアに付けるリプレイ（ゴースト）データ
+ * Entity とは別に、datastore に kind "Replay"、エンティティのキーを文字列にしたものをキー名として保存する
+ * @class
+ * @member {string} Kind ランキングの種類
+ * @member {*datastore.Key} Entry リプレイを付けたエンティティのキー
+ * @member {int} Score エンティティの得点
+ * @member {int} Size 圧縮前のサイズ
+ * @member {[]byte} Data gzip で圧縮したリプレイ
+ * @member {time.Time} Created 登録日時
+ */
+type Replay struct {
+	Kind string
+	Entry *datastore.Key
+	Score int
+	Size int
+	Data []byte `datastore:",noindex"`
+	Created time.Time
+}
+
+/**
+ * リプレイのキーを返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {*datastore.Key} entry リプレイを付けたエンティティのキー
+ * @returns {*datastore.Key} リプレイのキー
+ */
+func replayKey(c appengine.Context, entry *datastore.Key) *datastore.Key {
+	return datastore.NewKey(c, "Replay", entry.Encode(), 0, nil)
+}
+
+/**
+ * リクエストからリプレイを読み込んで圧縮する
+ * リプレイは multipart/form-data の replay で送信する
+ * @method
+ * @memberof Board
+ * @param {*http.Request} r リクエスト
+ * @returns {*Replay} 圧縮したリプレイ（送信されていなければ nil）
+ * @returns {error} 受け付けられなければエラー
+ */
+func (this *Board) requestReplay(r *http.Request) (*Replay, error) {
+	var file io.ReadCloser
+	var data []byte
+	var buffer bytes.Buffer
+	var writer *gzip.Writer
+	var replay *Replay
+	var err error
+	
+	file, _, err = r.FormFile("replay")
+	if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if this.MaxReplayBytes <= 0 {
+		return nil, errors.New("このランキングではリプレイを受け付けていません")
+	}
+	
+	data, err = ioutil.ReadAll(io.LimitReader(file, int64(this.MaxReplayBytes) + 1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > this.MaxReplayBytes {
+		return nil, errors.New("リプレイが大きすぎます")
+	}
+	
+	writer = gzip.NewWriter(&buffer)
+	_, err = writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	
+	replay = new(Replay)
+	replay.Kind = this.ID
+	replay.Size = len(data)
+	replay.Data = buffer.Bytes()
+	return replay, nil
+}
+
+/**
+ * リプレイを保存する
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {*Replay} replay リプレイ
+ * @param {*datastore.Key} entry リプレイを付けたエンティティのキー
+ * @param {*Entity} entity リプレイを付けたエンティティ
+ * @returns {error} エラー
+ */
+func saveReplay(c appengine.Context, replay *Replay, entry *datastore.Key, entity *Entity) error {
+	var err error
+	replay.Entry = entry
+	replay.Score = entity.Score
+	replay.Created = entity.Created
+	_, err = datastore.Put(c, replayKey(c, entry), replay)
+	return err
+}
+
+/**
+ * 承認待ちの送信に付けていたリプレイを、承認後のエンティティに付け替える
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {*datastore.Key} pending 承認待ちの送信のキー
+ * @param {*datastore.Key} entry 承認後のエンティティのキー
+ * @param {*Entity} entity 承認後のエンティティ
+ * @returns {error} エラー
+ */
+func moveReplay(c appengine.Context, pending *datastore.Key, entry *datastore.Key, entity *Entity) error {
+	var replay *Replay
+	var err error
+	
+	replay = new(Replay)
+	err = datastore.Get(c, replayKey(c, pending), replay)
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = saveReplay(c, replay, entry, entity)
+	if err != nil {
+		return err
+	}
+	return datastore.Delete(c, replayKey(c, pending))
+}
+
+/**
+ * リプレイをダウンロードする
+ * key には putRanking や getRanking が返したエンティティのキーを指定する
+ * /getreplay?key=xxxxxx
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func getReplay(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var entry *datastore.Key
+	var replay *Replay
+	var reader *gzip.Reader
+	var err error
+	
+	c = appengine.NewContext(r)
+	
+	entry, err = datastore.DecodeKey(r.FormValue("key"))
+	if err != nil {
+		writeError(c, w, http.StatusBadRequest, "key が正しくありません")
+		return
+	}
+	replay = new(Replay)
+	err = datastore.Get(c, replayKey(c, entry), replay)
+	if err != nil || replay.Entry.Kind() == "Pending" {
+		writeError(c, w, http.StatusNotFound, "リプレイが見つかりません")
+		return
+	}
+	
+	reader, err = gzip.NewReader(bytes.NewReader(replay.Data))
+	check(c, err)
+	if err != nil {
+		writeError(c, w, http.StatusInternalServerError, "リプレイを展開できませんでした")
+		return
+	}
+	defer reader.Close()
+	
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(replay.Size))
+	_, err = io.Copy(w, reader)
+	check(c, err)
+}
+
+/**
+ * 上位から外れたエンティティのリプレイを削除する
+ * エンティティが削除されたリプレイや、承認待ちの送信が承認か却下でなくなったリプレイも削除する
+ * cron から定期的に呼び出す
+ * /prunereplays
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func pruneReplays(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var boards []*Board
+	var result map[string]int
+	var i int
+	var err error
+	
+	c = appengine.NewContext(r)
+	if !requireAdmin(c, w, r) {
+		return
+	}
+	
+	boards, err = loadBoards(c)
+	check(c, err)
+	
+	result = make(map[string]int)
+	for i = 0; i < len(boards); i++ {
+		if boards[i].MaxReplayBytes <= 0 {
+			continue
+		}
+		result[boards[i].ID], err = boards[i].pruneReplays(c)
+		check(c, err)
+	}
+	
+	writeJSON(c, w, result)
+}
+
+/**
+ * ランキングの上位から外れたエンティティのリプレイを削除する
+ * リプレイのキーをカーソルで replayBatchSize 件ずつ読み、まとめて確認して削除する
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @returns {int} 削除した件数
+ * @returns {error} エラー
+ */
+func (this *Board) pruneReplays(c appengine.Context) (int, error) {
+	var topN int
+	var cutoff []*Entity
+	var query *datastore.Query
+	var iterator *datastore.Iterator
+	var cursor datastore.Cursor
+	var keys []*datastore.Key
+	var key *datastore.Key
+	var count int
+	var deleted int
+	var err error
+	
+	topN = this.ReplayTopN
+	if topN <= 0 {
+		topN = defaultReplayTopN
+	}
+	_, err = datastore.NewQuery(this.ID).Order(sortOrder).Offset(topN - 1).Limit(1).GetAll(c, &cutoff)
+	if err != nil {
+		return 0, err
+	}
+	
+	// リプレイのデータは大きいので読み込まず、キーだけを読む
+	query = datastore.NewQuery("Replay").Filter("Kind =", this.ID).KeysOnly().Limit(replayBatchSize)
+	for {
+		keys = make([]*datastore.Key, 0, replayBatchSize)
+		iterator = query.Run(c)
+		for {
+			key, err = iterator.Next(nil)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				return deleted, err
+			}
+			keys = append(keys, key)
+		}
+		if len(keys) < replayBatchSize {
+			count, err = this.pruneReplayBatch(c, cutoff, keys)
+			return deleted + count, err
+		}
+		cursor, err = iterator.Cursor()
+		if err != nil {
+			return deleted, err
+		}
+		count, err = this.pruneReplayBatch(c, cutoff, keys)
+		deleted += count
+		if err != nil {
+			return deleted, err
+		}
+		query = query.Start(cursor)
+	}
+}
+
+/**
+ * リプレイのキーのうち、削除してよいものを削除する
+ * キー名からエンティティのキーを復元して、エンティティが残っているかと上位に入っているかを確認する
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @param {[]*Entity} cutoff 上位の最後のエンティティ（上位の件数に満たなければ空）
+ * @param {[]*datastore.Key} keys リプレイのキー
+ * @returns {int} 削除した件数
+ * @returns {error} エラー
+ */
+func (this *Board) pruneReplayBatch(c appengine.Context, cutoff []*Entity, keys []*datastore.Key) (int, error) {
+	var entries []*datastore.Key
+	var targets []*datastore.Key
+	var entity *Entity
+	var i int
+	var err error
+	
+	entries = make([]*datastore.Key, len(keys))
+	for i = 0; i < len(keys); i++ {
+		entries[i], err = datastore.DecodeKey(keys[i].StringID())
+		if err != nil {
+			return 0, err
+		}
+	}
+	
+	// エンティティ（承認待ちの送信）が残っているかどうかをまとめて確認する
+	var lookup []*datastore.Key
+	var pendings []*datastore.Key
+	lookup = make([]*datastore.Key, 0, len(entries))
+	pendings = make([]*datastore.Key, 0)
+	for i = 0; i < len(entries); i++ {
+		if entries[i].Kind() == "Pending" {
+			pendings = append(pendings, entries[i])
+		} else {
+			lookup = append(lookup, entries[i])
+		}
+	}
+	var exists map[string]*Entity
+	var pending map[string]bool
+	exists, err = existingKeys(c, lookup)
+	if err != nil {
+		return 0, err
+	}
+	pending, err = existingPendings(c, pendings)
+	if err != nil {
+		return 0, err
+	}
+	
+	targets = make([]*datastore.Key, 0)
+	for i = 0; i < len(keys); i++ {
+		if entries[i].Kind() == "Pending" {
+			// 承認か却下で承認待ちの送信がなくなったリプレイは削除する
+			if !pending[keys[i].StringID()] {
+				targets = append(targets, keys[i])
+			}
+			continue
+		}
+		entity = exists[keys[i].StringID()]
+		if entity == nil || (len(cutoff) > 0 && this.better(cutoff[0], entity)) {
+			targets = append(targets, keys[i])
+		}
+	}
+	if len(targets) == 0 {
+		return 0, nil
+	}
+	err = datastore.DeleteMulti(c, targets)
+	if err != nil {
+		return 0, err
+	}
+	return len(targets), nil
+}
+
+/**
+ * エンティティが存在するキーを調べる
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {[]*datastore.Key} keys 調べるキー
+ * @returns {map[string]*Entity} 存在するキーを文字列にしたものとそのエンティティ
+ * @returns {error} エラー
+ */
+func existingKeys(c appengine.Context, keys []*datastore.Key) (map[string]*Entity, error) {
+	var entities []*Entity
+	var exists map[string]*Entity
+	var errs datastore.MultiError
+	var ok bool
+	var i int
+	var err error
+	
+	exists = make(map[string]*Entity)
+	if len(keys) == 0 {
+		return exists, nil
+	}
+	entities = make([]*Entity, len(keys))
+	for i = 0; i < len(keys); i++ {
+		entities[i] = new(Entity)
+	}
+	err = datastore.GetMulti(c, keys, entities)
+	errs, ok = err.(datastore.MultiError)
+	if err != nil && !ok {
+		return nil, err
+	}
+	for i = 0; i < len(keys); i++ {
+		if err == nil || errs[i] == nil {
+			exists[keys[i].Encode()] = entities[i]
+		}
+	}
+	return exists, nil
+}
+
+/**
+ * 承認待ちの送信が存在するキーを調べる
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {[]*datastore.Key} keys 調べる承認待ちの送信のキー
+ * @returns {map[string]bool} 存在するキーを文字列にしたもの
+ * @returns {error} エラー
+ */
+func existingPendings(c appengine.Context, keys []*datastore.Key) (map[string]bool, error) {
+	var pendings []*Pending
+	var exists map[string]bool
+	var errs datastore.MultiError
+	var ok bool
+	var i int
+	var err error
+	
+	exists = make(map[string]bool)
+	if len(keys) == 0 {
+		return exists, nil
+	}
+	pendings = make([]*Pending, len(keys))
+	for i = 0; i < len(keys); i++ {
+		pendings[i] = new(Pending)
+	}
+	err = datastore.GetMulti(c, keys, pendings)
+	errs, ok = err.(datastore.MultiError)
+	if err != nil && !ok {
+		return nil, err
+	}
+	for i = 0; i < len(keys); i++ {
+		if err == nil || errs[i] != datastore.ErrNoSuchEntity {
+			exists[keys[i].Encode()] = true
+		}
+	}
+	return exists, nil
+}
@@ -0,0 +1,145 @@
+/**
+ * ランキングへの得点送信に付ける署名を作成する
+ * クライアント（Go 製のツールやテスト）とサーバの両方から使う
+ * 署名はゲームごとの秘密鍵を使った HMAC-SHA256 で、
+ * kind, name, score, ts, nonce を改行でつないだ文字列に対して計算する
+ * 順位の基準を宣言したランキングでは、基準の値も宣言した順に後ろにつなぐ
+ */
+package scoresign
+
+import(
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * 署名する文字列を作成する
+ * @function
+ * @param {string} kind ランキングの種類
+ * @param {string} name プレイヤー名
+ * @param {int} score 得点
+ * @param {int64} timestamp 送信日時（UNIX時間の秒）
+ * @param {string} nonce 送信ごとに異なる文字列
+ * @param {[]int} values 順位の基準の値（基準がなければ nil）
+ * @returns {string} 署名する文字列
+ */
+func Message(kind string, name string, score int, timestamp int64, nonce string, values []int) string {
+	var fields []string
+	var i int
+	
+	fields = []string{kind, name, strconv.Itoa(score), strconv.FormatInt(timestamp, 10), nonce}
+	for i = 0; i < len(values); i++ {
+		fields = append(fields, strconv.Itoa(values[i]))
+	}
+	return strings.Join(fields, "\n")
+}
+
+/**
+ * 署名を作成する
+ * @function
+ * @param {string} secret ゲームごとの秘密鍵
+ * @param {string} kind ランキングの種類
+ * @param {string} name プレイヤー名
+ * @param {int} score 得点
+ * @param {int64} timestamp 送信日時（UNIX時間の秒）
+ * @param {string} nonce 送信ごとに異なる文字列
+ * @param {[]int} values 順位の基準の値（基準がなければ nil）
+ * @returns {string} 16進数の署名
+ */
+func Sign(secret string, kind string, name string, score int, timestamp int64, nonce string, values []int) string {
+	var mac = hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(Message(kind, name, score, timestamp, nonce, values)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/**
+ * 署名が正しいかどうかを確認する
+ * @function
+ * @param {string} secret ゲームごとの秘密鍵
+ * @param {string} kind ランキングの種類
+ * @param {string} name プレイヤー名
+ * @param {int} score 得点
+ * @param {int64} timestamp 送信日時（UNIX時間の秒）
+ * @param {string} nonce 送信ごとに異なる文字列
+ * @param {[]int} values 順位の基準の値（基準がなければ nil）
+ * @param {string} signature 16進数の署名
+ * @returns {bool} 正しければ true
+ */
+func Verify(secret string, kind string, name string, score int, timestamp int64, nonce string, values []int, signature string) bool {
+	var expected []byte
+	var actual []byte
+	var err error
+	
+	expected, err = hex.DecodeString(Sign(secret, kind, name, score, timestamp, nonce, values))
+	if err != nil {
+		return false
+	}
+	actual, err = hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(expected, actual)
+}
+
+/**
+ * ランダムな nonce を作成する
+ * @function
+ * @returns {string} 32文字の16進数
+ * @returns {error} 乱数を取得できなければエラー
+ */
+func NewNonce() (string, error) {
+	var buffer []byte
+	var err error
+	
+	buffer = make([]byte, 16)
+	_, err = rand.Read(buffer)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buffer), nil
+}
+
+/**
+ * 署名付きで /putranking に送るパラメータを作成する
+ * 送信日時には現在時刻、nonce には NewNonce の値を使う
+ * @function
+ * @param {string} secret ゲームごとの秘密鍵
+ * @param {string} kind ランキングの種類
+ * @param {string} name プレイヤー名
+ * @param {int} score 得点
+ * @param {[]string} criteria 順位の基準の名前（ランキングで宣言した順、基準がなければ nil）
+ * @param {[]int} scores criteria と同じ順の基準の値
+ * @returns {url.Values} kind, name, score, score.基準の名前, ts, nonce, sig を含むパラメータ
+ * @returns {error} エラー
+ */
+func Values(secret string, kind string, name string, score int, criteria []string, scores []int) (url.Values, error) {
+	var values url.Values
+	var timestamp int64
+	var nonce string
+	var i int
+	var err error
+	
+	nonce, err = NewNonce()
+	if err != nil {
+		return nil, err
+	}
+	timestamp = time.Now().Unix()
+	
+	values = url.Values{}
+	values.Set("kind", kind)
+	values.Set("name", name)
+	values.Set("score", strconv.Itoa(score))
+	for i = 0; i < len(criteria); i++ {
+		values.Set("score." + criteria[i], strconv.Itoa(scores[i]))
+	}
+	values.Set("ts", strconv.FormatInt(timestamp, 10))
+	values.Set("nonce", nonce)
+	values.Set("sig", Sign(secret, kind, name, score, timestamp, nonce, scores))
+	return values, nil
+}
@@ -0,0 +1,132 @@
+package scoresign
+
+import(
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+/**
+ * Sign で作った署名を Verify で確認できること
+ * @function
+ * @param {*testing.T} t テスト
+ */
+func TestSignVerify(t *testing.T) {
+	var signature string
+	
+	signature = Sign("secret", "score", "player", 1234, 1370000000, "abcdef", nil)
+	if !Verify("secret", "score", "player", 1234, 1370000000, "abcdef", nil, signature) {
+		t.Errorf("Verify(Sign(...)) = false, want true")
+	}
+}
+
+/**
+ * 順位の基準の値も署名に含まれ、書き換えたり省いたりすると Verify に失敗すること
+ * @function
+ * @param {*testing.T} t テスト
+ */
+func TestVerifyValues(t *testing.T) {
+	var signature string
+	var tests []struct {
+		name string
+		values []int
+		ok bool
+	}
+	var i int
+	
+	signature = Sign("secret", "score", "player", 3, 1370000000, "abcdef", []int{3, 5230})
+	tests = []struct {
+		name string
+		values []int
+		ok bool
+	}{
+		{"same", []int{3, 5230}, true},
+		{"changed", []int{3, 1000}, false},
+		{"swapped", []int{5230, 3}, false},
+		{"missing", []int{3}, false},
+		{"nil", nil, false},
+		{"extra", []int{3, 5230, 0}, false},
+	}
+	for i = 0; i < len(tests); i++ {
+		if Verify("secret", "score", "player", 3, 1370000000, "abcdef", tests[i].values, signature) != tests[i].ok {
+			t.Errorf("%s: Verify = %v, want %v", tests[i].name, !tests[i].ok, tests[i].ok)
+		}
+	}
+	if Message("score", "player", 3, 1370000000, "abcdef", nil) != Message("score", "player", 3, 1370000000, "abcdef", []int{}) {
+		t.Errorf("Message with empty values differs from Message with nil values")
+	}
+}
+
+/**
+ * 署名した値を1つでも書き換えると Verify に失敗すること
+ * @function
+ * @param {*testing.T} t テスト
+ */
+func TestVerifyTampered(t *testing.T) {
+	var signature string
+	var tests []struct {
+		name string
+		ok bool
+	}
+	var tampered []byte
+	var i int
+	
+	signature = Sign("secret", "score", "player", 1234, 1370000000, "abcdef", nil)
+	tampered = []byte(signature)
+	if tampered[0] == '0' {
+		tampered[0] = '1'
+	} else {
+		tampered[0] = '0'
+	}
+	tests = []struct {
+		name string
+		ok bool
+	}{
+		{"secret", Verify("other", "score", "player", 1234, 1370000000, "abcdef", nil, signature)},
+		{"kind", Verify("secret", "time", "player", 1234, 1370000000, "abcdef", nil, signature)},
+		{"name", Verify("secret", "score", "cheater", 1234, 1370000000, "abcdef", nil, signature)},
+		{"score", Verify("secret", "score", "player", 99999, 1370000000, "abcdef", nil, signature)},
+		{"ts", Verify("secret", "score", "player", 1234, 1370000001, "abcdef", nil, signature)},
+		{"nonce", Verify("secret", "score", "player", 1234, 1370000000, "abcdeg", nil, signature)},
+		{"sig", Verify("secret", "score", "player", 1234, 1370000000, "abcdef", nil, string(tampered))},
+		{"sig not hex", Verify("secret", "score", "player", 1234, 1370000000, "abcdef", nil, "xyz")},
+	}
+	for i = 0; i < len(tests); i++ {
+		if tests[i].ok {
+			t.Errorf("tampered %s: Verify = true, want false", tests[i].name)
+		}
+	}
+}
+
+/**
+ * Values で作ったパラメータの署名を Verify で確認できること
+ * @function
+ * @param {*testing.T} t テスト
+ */
+func TestValues(t *testing.T) {
+	var values url.Values
+	var score int
+	var timestamp int64
+	var time int
+	var err error
+	
+	values, err = Values("secret", "score", "player", 1234, []string{"time"}, []int{5230})
+	if err != nil {
+		t.Fatal(err)
+	}
+	score, err = strconv.Atoi(values.Get("score"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp, err = strconv.ParseInt(values.Get("ts"), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time, err = strconv.Atoi(values.Get("score.time"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Verify("secret", values.Get("kind"), values.Get("name"), score, timestamp, values.Get("nonce"), []int{time}, values.Get("sig")) {
+		t.Errorf("Verify(Values(...)) = false, want true")
+	}
+}
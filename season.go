@@ -0,0 +1,431 @@
+package okanoworld
+
+import(
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"appengine"
+	"appengine/datastore"
+)
+
+/**
+ * 確定時に保存する上位件数の初期値
+ */
+const defaultStandingSize = 100
+
+/**
+ * 一覧で返す入賞者の人数
+ */
+const winnerCount = 3
+
+/**
+ * シーズン
+ * datastore には kind "Season"、ランキングの設定のキーを親として保存する
+ * @class
+ * @member {string} Name 表示名
+ * @member {time.Time} Start 開始日時
+ * @member {time.Time} End 終了日時（この日時を含まない）
+ * @member {int} Size 終了時に確定させる上位件数
+ * @member {bool} Closed 最終順位を確定させたかどうか
+ */
+type Season struct {
+	Name string
+	Start time.Time
+	End time.Time
+	Size int
+	Closed bool
+}
+
+/**
+ * シーズンの最終順位
+ * datastore には kind "Standing"、シーズンのキーを親、順位を数値IDとして保存する
+ * @class
+ * @member {int} Rank 順位
+ * @member {string} Key シーズン中のランキングでのエンティティのキー
+ * @member {string} Name プレイヤー名
+ * @member {int} Score 得点
+ * @member {[]int} Values 得点が同じときに順位を決める値
+ * @member {string} Player プレイヤーID
+ * @member {time.Time} Created 登録日時
+ * @member {Metadata} Meta 追加項目
+ */
+type Standing struct {
+	Rank int
+	Key string
+	Name string
+	Score int
+	Values []int `datastore:",noindex" json:",omitempty"`
+	Player string `json:",omitempty"`
+	Created time.Time
+	Meta Metadata `datastore:",noindex" json:",omitempty"`
+}
+
+/**
+ * getSeasons の応答に含めるシーズンの情報
+ * @member {string} ID シーズンID
+ * @member {[]*Standing} Winners 上位入賞者（確定済みのシーズンのみ）
+ */
+type SeasonSummary struct {
+	ID string
+	*Season
+	Winners []*Standing
+}
+
+/**
+ * シーズン中のランキングを保存する kind 名を返す
+ * 例: score@season:2013summer
+ * @function
+ * @param {string} kind ランキングの種類
+ * @param {string} id シーズンID
+ * @returns {string} kind 名
+ */
+func seasonKind(kind string, id string) string {
+	return strings.Join([]string{kind, "@season:", id}, "")
+}
+
+/**
+ * シーズンのキーを返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} kind ランキングの種類
+ * @param {string} id シーズンID
+ * @returns {*datastore.Key} シーズンのキー
+ */
+func seasonKey(c appengine.Context, kind string, id string) *datastore.Key {
+	return datastore.NewKey(c, "Season", id, 0, boardKey(c, kind))
+}
+
+/**
+ * 指定した時刻に開催中のシーズンのIDを返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} kind ランキングの種類
+ * @param {time.Time} t 時刻
+ * @returns {[]string} シーズンIDのリスト
+ */
+func activeSeasons(c appengine.Context, kind string, t time.Time) []string {
+	var keys []*datastore.Key
+	var seasons []*Season
+	var ids []string
+	var i int
+	var err error
+	
+	keys, err = datastore.NewQuery("Season").Ancestor(boardKey(c, kind)).GetAll(c, &seasons)
+	check(c, err)
+	
+	ids = make([]string, 0)
+	for i = 0; i < len(seasons); i++ {
+		if !seasons[i].Closed && !t.Before(seasons[i].Start) && t.Before(seasons[i].End) {
+			ids = append(ids, keys[i].StringID())
+		}
+	}
+	return ids
+}
+
+/**
+ * シーズンを登録する
+ * 管理者のみ実行できる
+ * 日時は RFC3339 で指定する
+ * /putseason?kind=xxxxxx&id=xxxxxx&name=xxxxxx&start=2013-07-01T00:00:00+09:00&end=2013-09-01T00:00:00+09:00&size=100
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func putSeason(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var kind string
+	var id string
+	var season *Season
+	var err error
+	
+	c = appengine.NewContext(r)
+	if !requireAdmin(c, w, r) {
+		return
+	}
+	
+	var board *Board
+	board = requestBoard(c, w, r)
+	if board == nil {
+		return
+	}
+	kind = board.ID
+	id = r.FormValue("id")
+	if id == "" {
+		writeError(c, w, http.StatusBadRequest, "id が指定されていません")
+		return
+	}
+	// id は kind 名の一部になるので、区分の値と同じ文字だけを使える
+	if !partitionPattern.MatchString(id) {
+		writeError(c, w, http.StatusBadRequest, "id が正しくありません")
+		return
+	}
+	
+	season = new(Season)
+	season.Name = r.FormValue("name")
+	season.Start, err = time.Parse(time.RFC3339, r.FormValue("start"))
+	if err != nil {
+		writeError(c, w, http.StatusBadRequest, "start が正しくありません")
+		return
+	}
+	season.End, err = time.Parse(time.RFC3339, r.FormValue("end"))
+	if err != nil || !season.End.After(season.Start) {
+		writeError(c, w, http.StatusBadRequest, "end が正しくありません")
+		return
+	}
+	season.Size = defaultStandingSize
+	if r.FormValue("size") != "" {
+		season.Size, err = strconv.Atoi(r.FormValue("size"))
+		if err != nil || season.Size <= 0 {
+			writeError(c, w, http.StatusBadRequest, "size が正しくありません")
+			return
+		}
+	}
+	
+	_, err = datastore.Put(c, seasonKey(c, kind, id), season)
+	check(c, err)
+	var detail []byte
+	detail, err = json.Marshal(season)
+	check(c, err)
+	audit(c, "putseason", kind, id, string(detail))
+	
+	writeJSON(c, w, season)
+}
+
+/**
+ * シーズンの一覧と入賞者を取得する
+ * 管理者のみ実行できる
+ * /getseasons?kind=xxxxxx
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func getSeasons(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var keys []*datastore.Key
+	var seasons []*Season
+	var summaries []*SeasonSummary
+	var summary *SeasonSummary
+	var i int
+	var err error
+	
+	c = appengine.NewContext(r)
+	if !requireAdmin(c, w, r) {
+		return
+	}
+	
+	keys, err = datastore.NewQuery("Season").Ancestor(boardKey(c, r.FormValue("kind"))).GetAll(c, &seasons)
+	check(c, err)
+	
+	summaries = make([]*SeasonSummary, len(seasons))
+	for i = 0; i < len(seasons); i++ {
+		summary = new(SeasonSummary)
+		summary.ID = keys[i].StringID()
+		summary.Season = seasons[i]
+		summary.Winners = make([]*Standing, 0)
+		if seasons[i].Closed {
+			summary.Winners, err = loadStandings(c, keys[i], winnerCount, 0)
+			check(c, err)
+		}
+		summaries[i] = summary
+	}
+	
+	writeJSON(c, w, summaries)
+}
+
+/**
+ * 終了したシーズンの最終順位を確定させる
+ * cron から定期的に呼び出す
+ * /closeseasons
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func closeSeasons(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var keys []*datastore.Key
+	var seasons []*Season
+	var closed []string
+	var now time.Time
+	var i int
+	var err error
+	
+	c = appengine.NewContext(r)
+	if !requireAdmin(c, w, r) {
+		return
+	}
+	
+	now = time.Now()
+	keys, err = datastore.NewQuery("Season").Filter("Closed =", false).GetAll(c, &seasons)
+	check(c, err)
+	
+	closed = make([]string, 0)
+	for i = 0; i < len(seasons); i++ {
+		if now.Before(seasons[i].End) {
+			continue
+		}
+		err = closeSeason(c, keys[i], seasons[i])
+		check(c, err)
+		if err == nil {
+			closed = append(closed, seasonKind(keys[i].Parent().StringID(), keys[i].StringID()))
+			audit(c, "closeseason", keys[i].Parent().StringID(), keys[i].StringID(), "")
+		}
+	}
+	
+	writeJSON(c, w, closed)
+}
+
+/**
+ * シーズンの上位を最終順位として保存し、シーズンを確定済みにする
+ * 途中で失敗しても再実行すれば同じ順位で上書きされる
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {*datastore.Key} key シーズンのキー
+ * @param {*Season} season シーズン
+ * @returns {error} エラー
+ */
+func closeSeason(c appengine.Context, key *datastore.Key, season *Season) error {
+	var kind string
+	var keys []*datastore.Key
+	var entities []*Entity
+	var standingKeys []*datastore.Key
+	var standings []*Standing
+	var i int
+	var err error
+	
+	var board *Board
+	board, err = loadBoard(c, key.Parent().StringID())
+	if err != nil {
+		return err
+	}
+	kind = seasonKind(key.Parent().StringID(), key.StringID())
+	keys, err = datastore.NewQuery(kind).Order(sortOrder).Limit(season.Size).GetAll(c, &entities)
+	if err != nil {
+		return err
+	}
+	
+	standingKeys = make([]*datastore.Key, len(entities))
+	standings = make([]*Standing, len(entities))
+	for i = 0; i < len(entities); i++ {
+		standingKeys[i] = datastore.NewKey(c, "Standing", "", int64(i + 1), key)
+		standings[i] = new(Standing)
+		// 同じ成績なら直前と同じ順位にする
+		if i > 0 && board.rankKey(entities[i]) == board.rankKey(entities[i - 1]) {
+			standings[i].Rank = standings[i - 1].Rank
+		} else {
+			standings[i].Rank = i + 1
+		}
+		standings[i].Key = keys[i].Encode()
+		standings[i].Name = entities[i].Name
+		standings[i].Score = entities[i].Score
+		standings[i].Values = entities[i].Values
+		standings[i].Player = entities[i].Player
+		standings[i].Created = entities[i].Created
+		standings[i].Meta = entities[i].Meta
+	}
+	if len(standings) > 0 {
+		_, err = datastore.PutMulti(c, standingKeys, standings)
+		if err != nil {
+			return err
+		}
+	}
+	
+	season.Closed = true
+	_, err = datastore.Put(c, key, season)
+	return err
+}
+
+/**
+ * 確定済みの最終順位を取得する
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {*datastore.Key} key シーズンのキー
+ * @param {int} limit 取得する件数
+ * @param {int} offset 読み飛ばす件数
+ * @returns {[]*Standing} 最終順位
+ * @returns {error} エラー
+ */
+func loadStandings(c appengine.Context, key *datastore.Key, limit int, offset int) ([]*Standing, error) {
+	var standings []*Standing
+	var err error
+	
+	standings = make([]*Standing, 0, limit)
+	_, err = datastore.NewQuery("Standing").Ancestor(key).Offset(offset).Limit(limit).GetAll(c, &standings)
+	return standings, err
+}
+
+/**
+ * 確定済みの最終順位をランキングデータの形にする
+ * @method
+ * @memberof Standing
+ * @returns {*RankedEntity} 順位付きのランキングデータ
+ */
+func (this *Standing) ranked() *RankedEntity {
+	var ranked *RankedEntity
+	ranked = new(RankedEntity)
+	ranked.Rank = this.Rank
+	ranked.Key = this.Key
+	ranked.Entity = new(Entity)
+	ranked.Entity.Name = this.Name
+	ranked.Entity.Score = this.Score
+	ranked.Entity.Values = this.Values
+	ranked.Entity.Player = this.Player
+	ranked.Entity.Created = this.Created
+	ranked.Entity.Meta = this.Meta
+	return ranked
+}
+
+/**
+ * 終了したシーズンなら getRanking の応答として最終順位を出力する
+ * 確定済みの最終順位は上位 Size 件だけなので cursor には対応せず offset で取得する
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @param {int} limit 取得する件数
+ * @param {int} offset 読み飛ばす件数
+ * @returns {bool} 出力した場合は true、シーズンが確定していなければ false
+ */
+func writeStandings(c appengine.Context, w http.ResponseWriter, r *http.Request, limit int, offset int) bool {
+	var key *datastore.Key
+	var season *Season
+	var standings []*Standing
+	var err error
+	
+	key = seasonKey(c, r.FormValue("kind"), r.FormValue("season"))
+	season = new(Season)
+	err = datastore.Get(c, key, season)
+	if err != nil || !season.Closed {
+		return false
+	}
+	
+	standings, err = loadStandings(c, key, limit, offset)
+	check(c, err)
+	
+	var entries []*RankedEntity
+	var entities []*Entity
+	var i int
+	entries = make([]*RankedEntity, len(standings))
+	entities = make([]*Entity, len(standings))
+	for i = 0; i < len(standings); i++ {
+		entries[i] = standings[i].ranked()
+		entities[i] = entries[i].Entity
+	}
+	showDisplayNames(c, entities)
+	
+	if r.FormValue("format") != "envelope" {
+		writeJSON(c, w, entities)
+		return true
+	}
+	
+	var page *RankingPage
+	var total int
+	page = new(RankingPage)
+	page.Entries = entries
+	total, err = datastore.NewQuery("Standing").Ancestor(key).KeysOnly().Count(c)
+	check(c, err)
+	page.Total = &total
+	writeJSON(c, w, page)
+	return true
+}
@@ -0,0 +1,155 @@
+package okanoworld
+
+import(
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+	"appengine"
+	"appengine/datastore"
+	"scoresign"
+)
+
+/**
+ * 署名付きの送信を受け付ける時刻のずれ
+ * これより古い（または未来の）送信日時は拒否する
+ */
+const signatureWindow = 5 * time.Minute
+
+/**
+ * pruneNonces で一度に削除する nonce の件数
+ */
+const nonceBatchSize = 500
+
+/**
+ * 使用済みの nonce
+ * datastore には kind "Nonce"、ランキングの設定のキーを親、nonce をキー名として保存する
+ * 期限を過ぎたものは pruneNonces で削除する
+ * @class
+ * @member {time.Time} Expires この日時を過ぎたら削除してよい
+ */
+type Nonce struct {
+	Expires time.Time
+}
+
+/**
+ * pruneNonces の応答
+ * @member {int} Deleted 削除した件数
+ * @member {bool} Done すべて削除し終わったかどうか（false ならもう一度呼び出す）
+ */
+type NonceResult struct {
+	Deleted int
+	Done bool
+}
+
+/**
+ * putRanking の署名を確認する
+ * ランキングに Secret が設定されていなければ何もしない
+ * 署名が正しければ nonce を使用済みとして保存する
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @param {*http.Request} r リクエスト
+ * @param {string} name プレイヤー名
+ * @param {int} score 得点
+ * @param {[]int} values 順位の基準の値
+ * @returns {error} 署名が正しくなければエラー
+ */
+func (this *Board) verifySignature(c appengine.Context, r *http.Request, name string, score int, values []int) error {
+	var timestamp int64
+	var nonce string
+	var sent time.Time
+	var err error
+	
+	if this.Secret == "" {
+		return nil
+	}
+	
+	timestamp, err = strconv.ParseInt(r.FormValue("ts"), 10, 64)
+	if err != nil {
+		return errors.New("ts が正しくありません")
+	}
+	sent = time.Unix(timestamp, 0)
+	if time.Since(sent) > signatureWindow || sent.Sub(time.Now()) > signatureWindow {
+		return errors.New("ts が古すぎるか未来の日時です")
+	}
+	
+	nonce = r.FormValue("nonce")
+	if nonce == "" || len(nonce) > 64 {
+		return errors.New("nonce が正しくありません")
+	}
+	if !scoresign.Verify(this.Secret, this.ID, name, score, timestamp, nonce, values, r.FormValue("sig")) {
+		return errors.New("署名が正しくありません")
+	}
+	
+	return useNonce(c, this.ID, nonce, sent.Add(signatureWindow))
+}
+
+/**
+ * nonce を使用済みにする
+ * すでに使われていればエラーを返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} kind ランキングの種類
+ * @param {string} nonce 送信ごとに異なる文字列
+ * @param {time.Time} expires 削除してよい日時
+ * @returns {error} 使用済みならエラー
+ */
+func useNonce(c appengine.Context, kind string, nonce string, expires time.Time) error {
+	var key *datastore.Key
+	key = datastore.NewKey(c, "Nonce", nonce, 0, boardKey(c, kind))
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var stored *Nonce
+		var err error
+		
+		stored = new(Nonce)
+		err = datastore.Get(c, key, stored)
+		if err == nil {
+			return errors.New("この nonce はすでに使われています")
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		
+		stored.Expires = expires
+		_, err = datastore.Put(c, key, stored)
+		return err
+	}, nil)
+}
+
+/**
+ * 期限を過ぎた nonce を削除する
+ * 期限を過ぎた送信日時は verifySignature で拒否するので、nonce を残しておく必要はない
+ * 一度に nonceBatchSize 件ずつ削除するので、Done が true になるまで繰り返し呼び出す
+ * cron から定期的に呼び出す（管理者のみ実行できる）
+ * /prunenonces
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func pruneNonces(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var keys []*datastore.Key
+	var err error
+	
+	c = appengine.NewContext(r)
+	if !requireAdmin(c, w, r) {
+		return
+	}
+	keys, err = datastore.NewQuery("Nonce").Filter("Expires <", time.Now()).KeysOnly().Limit(nonceBatchSize).GetAll(c, nil)
+	check(c, err)
+	if err == nil {
+		err = datastore.DeleteMulti(c, keys)
+		check(c, err)
+	}
+	if err != nil {
+		writeError(c, w, http.StatusInternalServerError, "nonce を削除できませんでした")
+		return
+	}
+	
+	var result *NonceResult
+	result = new(NonceResult)
+	result.Deleted = len(keys)
+	result.Done = len(keys) < nonceBatchSize
+	writeJSON(c, w, result)
+}
@@ -0,0 +1,459 @@
+package okanoworld
+
+import(
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+	"appengine"
+	"appengine/datastore"
+)
+
+/**
+ * スナップショットを取る上位件数の初期値
+ */
+const defaultSnapshotTopN = 100
+
+/**
+ * kind ごとに残すスナップショットの数
+ */
+const maxSnapshots = 30
+
+/**
+ * ランキングの上位の順位のスナップショット
+ * 順位の変動を求めるために定期的に保存する
+ * datastore には kind "Snapshot"、ランキングの設定のキーを親、"kind 名#日時" をキー名として保存する
+ * 同じプレイヤーが複数回入っているランキングでは一番上の順位だけを記録する
+ * @class
+ * @member {string} Kind スナップショットを取った kind 名
+ * @member {time.Time} Taken スナップショットを取った日時
+ * @member {[]string} Names プレイヤー名（プレイヤーとして送信したものはプレイヤーID）
+ * @member {[]string} Players プレイヤーID（プレイヤーとして送信していなければ空文字列）
+ * @member {[]int} Ranks 順位
+ */
+type Snapshot struct {
+	Kind string
+	Taken time.Time
+	Names []string `datastore:",noindex"`
+	Players []string `datastore:",noindex"`
+	Ranks []int `datastore:",noindex"`
+}
+
+/**
+ * 順位の変動
+ * @member {string} Name プレイヤー名
+ * @member {int} Rank 順位
+ * @member {int} PreviousRank 前回の順位
+ * @member {int} Change 上がった順位の数（下がった場合は負）
+ */
+type Mover struct {
+	Name string
+	Rank int
+	PreviousRank int
+	Change int
+}
+
+/**
+ * getMovers の応答
+ * @member {time.Time} From 比べたスナップショットの日時
+ * @member {time.Time} To 最新のスナップショットの日時
+ * @member {[]*Mover} Climbers 順位が上がったプレイヤー（上がった数の多い順）
+ * @member {[]*Mover} Fallers 順位が下がったプレイヤー（下がった数の多い順）
+ */
+type MoversResult struct {
+	From time.Time
+	To time.Time
+	Climbers []*Mover
+	Fallers []*Mover
+}
+
+/**
+ * スナップショットの順位をプレイヤー名で引けるようにする
+ * @method
+ * @memberof Snapshot
+ * @returns {map[string]int} プレイヤー名から順位への対応
+ */
+func (this *Snapshot) rankOf() map[string]int {
+	var ranks map[string]int
+	var i int
+	
+	ranks = make(map[string]int)
+	for i = 0; i < len(this.Names) && i < len(this.Ranks); i++ {
+		ranks[this.Names[i]] = this.Ranks[i]
+	}
+	return ranks
+}
+
+/**
+ * kind の最近のスナップショットを新しい順に読み込む
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} kind kind 名
+ * @param {int} count 読み込む数
+ * @returns {[]*datastore.Key} キーのリスト
+ * @returns {[]*Snapshot} スナップショット
+ * @returns {error} エラー
+ */
+func (this *Board) loadSnapshots(c appengine.Context, kind string, count int) ([]*datastore.Key, []*Snapshot, error) {
+	var keys []*datastore.Key
+	var snapshots []*Snapshot
+	var err error
+	
+	snapshots = make([]*Snapshot, 0, count)
+	keys, err = datastore.NewQuery("Snapshot").Ancestor(boardKey(c, this.ID)).Filter("Kind =", kind).Order("-Taken").Limit(count).GetAll(c, &snapshots)
+	return keys, snapshots, err
+}
+
+/**
+ * ランキングの上位のスナップショットを保存する
+ * 古いスナップショットは maxSnapshots を超えた分を削除する
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} kind kind 名
+ * @returns {*Snapshot} 保存したスナップショット
+ * @returns {error} エラー
+ */
+func (this *Board) takeSnapshot(c appengine.Context, kind string) (*Snapshot, error) {
+	var topN int
+	var entities []*Entity
+	var snapshot *Snapshot
+	var seen map[string]bool
+	var rank int
+	var i int
+	var err error
+	
+	topN = this.SnapshotTopN
+	if topN <= 0 {
+		topN = defaultSnapshotTopN
+	}
+	_, err = datastore.NewQuery(kind).Order(sortOrder).Limit(topN).GetAll(c, &entities)
+	if err != nil {
+		return nil, err
+	}
+	
+	snapshot = new(Snapshot)
+	snapshot.Kind = kind
+	snapshot.Taken = time.Now()
+	snapshot.Names = make([]string, 0, len(entities))
+	snapshot.Players = make([]string, 0, len(entities))
+	snapshot.Ranks = make([]int, 0, len(entities))
+	seen = make(map[string]bool)
+	for i = 0; i < len(entities); i++ {
+		if i == 0 || this.rankKey(entities[i]) != this.rankKey(entities[i - 1]) {
+			rank = i + 1
+		}
+		if entities[i].Name == "" || seen[entities[i].Name] {
+			continue
+		}
+		seen[entities[i].Name] = true
+		snapshot.Names = append(snapshot.Names, entities[i].Name)
+		snapshot.Players = append(snapshot.Players, entities[i].Player)
+		snapshot.Ranks = append(snapshot.Ranks, rank)
+	}
+	_, err = datastore.Put(c, datastore.NewKey(c, "Snapshot", fmt.Sprintf("%s#%d", kind, snapshot.Taken.Unix()), 0, boardKey(c, this.ID)), snapshot)
+	if err != nil {
+		return nil, err
+	}
+	
+	var keys []*datastore.Key
+	keys, err = datastore.NewQuery("Snapshot").Ancestor(boardKey(c, this.ID)).Filter("Kind =", kind).Order("-Taken").Offset(maxSnapshots).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return snapshot, err
+	}
+	return snapshot, datastore.DeleteMulti(c, keys)
+}
+
+/**
+ * 順位付きのランキングデータに前回のスナップショットからの順位の変動を付ける
+ * スナップショットに入っていなかったプレイヤーには付けない
+ * 同じプレイヤーが複数回入っていれば一番上のエンティティにだけ付ける
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} kind kind 名
+ * @param {[]*RankedEntity} entries 順位付きのランキングデータ
+ * @returns {error} エラー
+ */
+func (this *Board) attachChanges(c appengine.Context, kind string, entries []*RankedEntity) error {
+	var ranks map[string]int
+	var err error
+	
+	if len(entries) == 0 {
+		return nil
+	}
+	ranks, err = this.previousRanks(c, kind)
+	if err != nil {
+		return err
+	}
+	applyChanges(entries, ranks)
+	return nil
+}
+
+/**
+ * 最新のスナップショットの順位を読み込む
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} kind kind 名
+ * @returns {map[string]int} プレイヤー名から順位への対応（スナップショットがなければ nil）
+ * @returns {error} エラー
+ */
+func (this *Board) previousRanks(c appengine.Context, kind string) (map[string]int, error) {
+	var snapshots []*Snapshot
+	var err error
+	
+	_, snapshots, err = this.loadSnapshots(c, kind, 1)
+	if err != nil || len(snapshots) == 0 {
+		return nil, err
+	}
+	return snapshots[0].rankOf(), nil
+}
+
+/**
+ * 順位付きのランキングデータに、読み込んでおいたスナップショットの順位からの変動を付ける
+ * @function
+ * @param {[]*RankedEntity} entries 順位付きのランキングデータ
+ * @param {map[string]int} ranks プレイヤー名から前回の順位への対応（previousRanks の結果）
+ */
+func applyChanges(entries []*RankedEntity, ranks map[string]int) {
+	var seen map[string]bool
+	var previous int
+	var ok bool
+	var i int
+	
+	seen = make(map[string]bool)
+	for i = 0; i < len(entries); i++ {
+		previous, ok = ranks[entries[i].Name]
+		if !ok || seen[entries[i].Name] {
+			continue
+		}
+		seen[entries[i].Name] = true
+		entries[i].PreviousRank = previous
+		entries[i].Change = new(int)
+		*entries[i].Change = previous - entries[i].Rank
+	}
+}
+
+/**
+ * 順位のスナップショットを取る
+ * kind を指定しなければ、登録されているすべてのランキングの通常のランキングのスナップショットを取る
+ * kind と period などを指定すると、そのランキングのスナップショットだけを取る
+ * cron から定期的に呼び出す（管理者のみ実行できる）
+ * /snapshotranks
+ * /snapshotranks?kind=xxxxxx&period=week
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func snapshotRanks(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var boards []*Board
+	var kinds []string
+	var result map[string]int
+	var snapshot *Snapshot
+	var i int
+	var err error
+	
+	c = appengine.NewContext(r)
+	if !requireAdmin(c, w, r) {
+		return
+	}
+	
+	if r.FormValue("kind") != "" {
+		var board *Board
+		var kind string
+		board = requestBoard(c, w, r)
+		if board == nil {
+			return
+		}
+		kind, err = board.requestKind(c, r)
+		if err != nil {
+			writeError(c, w, http.StatusBadRequest, err.Error())
+			return
+		}
+		boards = []*Board{board}
+		kinds = []string{kind}
+	} else {
+		boards, err = loadBoards(c)
+		check(c, err)
+		kinds = make([]string, len(boards))
+		for i = 0; i < len(boards); i++ {
+			kinds[i] = boards[i].ID
+		}
+	}
+	
+	result = make(map[string]int)
+	for i = 0; i < len(boards); i++ {
+		snapshot, err = boards[i].takeSnapshot(c, kinds[i])
+		check(c, err)
+		if snapshot != nil {
+			result[kinds[i]] = len(snapshot.Names)
+			// キャッシュには前回のスナップショットの順位も入っているので読み込み直させる
+			invalidateTop(c, kinds[i])
+		}
+	}
+	
+	writeJSON(c, w, result)
+}
+
+/**
+ * 順位の変動が大きかったプレイヤーを取得する
+ * 最新のスナップショットと back 回前のスナップショット（省略時は1回前）を比べる
+ * 毎日スナップショットを取っているなら back=7 で1週間の変動になる
+ * /getmovers?kind=xxxxxx&limit=10&back=7
+ * period と date で期間別ランキングの変動を取得できる（スナップショットを取っている場合のみ）
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func getMovers(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var board *Board
+	var kind string
+	var limit int
+	var back int
+	var snapshots []*Snapshot
+	var ranks map[string]int
+	var movers []*Mover
+	var players map[string]string
+	var result *MoversResult
+	var i int
+	var err error
+	
+	c = appengine.NewContext(r)
+	board = requestBoard(c, w, r)
+	if board == nil {
+		return
+	}
+	kind, err = board.requestKind(c, r)
+	if err != nil {
+		writeError(c, w, http.StatusBadRequest, err.Error())
+		return
+	}
+	limit = 10
+	if r.FormValue("limit") != "" {
+		limit, err = strconv.Atoi(r.FormValue("limit"))
+		if err != nil || limit < 0 || limit > 100 {
+			writeError(c, w, http.StatusBadRequest, "limit は0から100で指定してください")
+			return
+		}
+	}
+	back = 1
+	if r.FormValue("back") != "" {
+		back, err = strconv.Atoi(r.FormValue("back"))
+		if err != nil || back < 1 || back >= maxSnapshots {
+			writeError(c, w, http.StatusBadRequest, fmt.Sprintf("back は1から%dで指定してください", maxSnapshots - 1))
+			return
+		}
+	}
+	
+	_, snapshots, err = board.loadSnapshots(c, kind, back + 1)
+	check(c, err)
+	if len(snapshots) < 2 {
+		writeError(c, w, http.StatusNotFound, "比べられるスナップショットがありません")
+		return
+	}
+	if back >= len(snapshots) {
+		back = len(snapshots) - 1
+	}
+	
+	result = new(MoversResult)
+	result.To = snapshots[0].Taken
+	result.From = snapshots[back].Taken
+	ranks = snapshots[back].rankOf()
+	movers = make([]*Mover, 0, len(snapshots[0].Names))
+	players = make(map[string]string)
+	for i = 0; i < len(snapshots[0].Names) && i < len(snapshots[0].Ranks); i++ {
+		var mover *Mover
+		var previous int
+		var ok bool
+		previous, ok = ranks[snapshots[0].Names[i]]
+		if !ok || previous == snapshots[0].Ranks[i] {
+			continue
+		}
+		mover = new(Mover)
+		mover.Name = snapshots[0].Names[i]
+		mover.Rank = snapshots[0].Ranks[i]
+		mover.PreviousRank = previous
+		mover.Change = previous - mover.Rank
+		movers = append(movers, mover)
+		if i < len(snapshots[0].Players) {
+			players[mover.Name] = snapshots[0].Players[i]
+		}
+	}
+	sort.Sort(moverSorter(movers))
+	
+	result.Climbers = make([]*Mover, 0, limit)
+	result.Fallers = make([]*Mover, 0, limit)
+	for i = 0; i < len(movers) && len(result.Climbers) < limit && movers[i].Change > 0; i++ {
+		result.Climbers = append(result.Climbers, movers[i])
+	}
+	for i = len(movers) - 1; i >= 0 && len(result.Fallers) < limit && movers[i].Change < 0; i-- {
+		result.Fallers = append(result.Fallers, movers[i])
+	}
+	
+	// プレイヤーとして送信したものは表示名にする
+	var entities []*Entity
+	entities = make([]*Entity, 0, len(result.Climbers) + len(result.Fallers))
+	for i = 0; i < len(result.Climbers); i++ {
+		entities = append(entities, &Entity{Name: result.Climbers[i].Name, Player: players[result.Climbers[i].Name]})
+	}
+	for i = 0; i < len(result.Fallers); i++ {
+		entities = append(entities, &Entity{Name: result.Fallers[i].Name, Player: players[result.Fallers[i].Name]})
+	}
+	showDisplayNames(c, entities)
+	for i = 0; i < len(result.Climbers); i++ {
+		result.Climbers[i].Name = entities[i].Name
+	}
+	for i = 0; i < len(result.Fallers); i++ {
+		result.Fallers[i].Name = entities[len(result.Climbers) + i].Name
+	}
+	
+	writeJSON(c, w, result)
+}
+
+/**
+ * 順位の変動を上がった数の多い順に並べ替える
+ * @class
+ */
+type moverSorter []*Mover
+
+/**
+ * 件数を返す
+ * @method
+ * @memberof moverSorter
+ * @returns {int} 件数
+ */
+func (this moverSorter) Len() int {
+	return len(this)
+}
+
+/**
+ * i 番目が j 番目より前に並ぶかどうか
+ * 変動が同じなら今の順位が上の方を前にする
+ * @method
+ * @memberof moverSorter
+ * @param {int} i 位置
+ * @param {int} j 位置
+ * @returns {bool} 前に並ぶなら true
+ */
+func (this moverSorter) Less(i int, j int) bool {
+	if this[i].Change != this[j].Change {
+		return this[i].Change > this[j].Change
+	}
+	return this[i].Rank < this[j].Rank
+}
+
+/**
+ * i 番目と j 番目を入れ替える
+ * @method
+ * @memberof moverSorter
+ * @param {int} i 位置
+ * @param {int} j 位置
+ */
+func (this moverSorter) Swap(i int, j int) {
+	this[i], this[j] = this[j], this[i]
+}
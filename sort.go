@@ -0,0 +1,305 @@
+package okanoworld
+
+import(
+	"fmt"
+	"net/http"
+	"strconv"
+	"appengine"
+	"appengine/datastore"
+)
+
+/**
+ * resortBoard で一度に更新するエンティティの件数
+ */
+const resortBatchSize = 200
+
+/**
+ * 上位から順に並べるときの並び順（datastore.Query.Order に渡す）
+ * 得点の上下は並び順のキーに含まれるので、どのランキングでも同じ
+ */
+const sortOrder = "SortKey"
+
+/**
+ * 下位から順に並べるときの並び順（datastore.Query.Order に渡す）
+ */
+const reverseSortOrder = "-SortKey"
+
+/**
+ * countRank で正確に数える順位の上限
+ * 数える件数だけ時間がかかるので、これより下の順位は統計の度数分布から見積もる
+ */
+const exactRankLimit = 1000
+
+/**
+ * resortBoard の応答
+ * @member {int} Updated 更新した件数
+ * @member {int} Index 次に呼び出すときに指定する kind の番号
+ * @member {string} Cursor 次に呼び出すときに指定するカーソル
+ * @member {bool} Done すべて更新し終わったかどうか
+ */
+type ResortResult struct {
+	Updated int
+	Index int
+	Cursor string
+	Done bool
+}
+
+/**
+ * 得点を並び順のキーの一部にする
+ * 上位ほど小さい文字列になるように、符号付きの整数を16桁の16進数にする
+ * @function
+ * @param {int} score 得点
+ * @param {bool} ascending 得点の低い方が上位なら true
+ * @returns {string} 16桁の16進数
+ */
+func encodeScore(score int, ascending bool) string {
+	var value uint64
+	value = uint64(int64(score)) ^ (1 << 63)
+	if !ascending {
+		value = ^value
+	}
+	return fmt.Sprintf("%016x", value)
+}
+
+/**
+ * 順位を決めるキーを返す
+ * 得点の後ろに順位の基準の値を宣言した順に並べたもので、このキーが同じエンティティは同じ順位になる
+ * 基準の値がないエンティティ（基準を宣言する前のデータや得点だけの指定）は得点だけのキーになり、同じ得点の先頭に並ぶ
+ * @method
+ * @memberof Board
+ * @param {*Entity} entity ランキングデータ
+ * @returns {string} 順位を決めるキー
+ */
+func (this *Board) rankKey(entity *Entity) string {
+	var criteria []*Criterion
+	var key string
+	var i int
+	
+	key = encodeScore(entity.Score, this.Ascending)
+	criteria = this.criteria()
+	for i = 0; i < len(criteria) && i < len(entity.Values); i++ {
+		key += encodeScore(entity.Values[i], criteria[i].Ascending)
+	}
+	return key
+}
+
+/**
+ * 並び順のキーを返す
+ * 順位を決めるキーの後ろに登録日時を付けて、同じ順位なら先に登録した方が上に並ぶようにする
+ * kind ごとに複合インデックスを用意できないので、並び替えはすべてこのキー1つで行う
+ * @method
+ * @memberof Board
+ * @param {*Entity} entity ランキングデータ
+ * @returns {string} 並び順のキー
+ */
+func (this *Board) sortKey(entity *Entity) string {
+	var created int64
+	
+	// 登録日時のない古いデータ（ゼロ値）は 1970 年より前になり、そのまま符号なしにすると最後に並んでしまう
+	// 1970 年より前は 0 にして、同じ順位の中で一番上に並べる
+	if entity.Created.Unix() > 0 {
+		created = entity.Created.UnixNano()
+	}
+	return this.rankKey(entity) + fmt.Sprintf("%016x", uint64(created))
+}
+
+/**
+ * エンティティ a がエンティティ b より上位かどうか
+ * 同じ順位なら false を返す
+ * @method
+ * @memberof Board
+ * @param {*Entity} a ランキングデータ
+ * @param {*Entity} b ランキングデータ
+ * @returns {bool} a の方が上位なら true
+ */
+func (this *Board) better(a *Entity, b *Entity) bool {
+	return this.rankKey(a) < this.rankKey(b)
+}
+
+/**
+ * 順位を求める
+ * 順位を決めるキーが自分より小さい件数を数えるので、同じ順位のエンティティは同じ順位になる
+ * 数えるのは exactRankLimit 件までで、それより下の順位は統計の度数分布から得点だけで見積もる（順位の基準は考えない）
+ * 統計がなければ exactRankLimit + 1 位を返す
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} kind ランキングの kind 名
+ * @param {*Entity} entity ランキングデータ
+ * @returns {int} 順位（1位から）
+ * @returns {error} エラー
+ */
+func (this *Board) countRank(c appengine.Context, kind string, entity *Entity) (int, error) {
+	var count int
+	var stats *Stats
+	var ahead float64
+	var err error
+	
+	count, err = datastore.NewQuery(kind).Filter("SortKey <", this.rankKey(entity)).Limit(exactRankLimit).KeysOnly().Count(c)
+	if err != nil || count < exactRankLimit {
+		return count + 1, err
+	}
+	stats, err = loadStats(c, kind)
+	if err != nil {
+		return count + 1, err
+	}
+	// 見積もりが数えた件数より少なければ、数えた件数を使う
+	ahead = stats.ahead(entity.Score, this.Ascending)
+	if ahead > float64(count) {
+		count = int(ahead)
+	}
+	return count + 1, nil
+}
+
+/**
+ * 並び順の位置を求める
+ * 同じ順位のエンティティでも登録日時で区別する
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} kind ランキングの kind 名
+ * @param {*Entity} entity ランキングデータ
+ * @returns {int} 位置（1から）
+ * @returns {error} エラー
+ */
+func (this *Board) countPosition(c appengine.Context, kind string, entity *Entity) (int, error) {
+	var count int
+	var err error
+	
+	count, err = datastore.NewQuery(kind).Filter("SortKey <", this.sortKey(entity)).KeysOnly().Count(c)
+	return count + 1, err
+}
+
+/**
+ * 並び順に取得したエンティティに順位を付ける
+ * 同じ順位のエンティティには同じ順位を付け、その次は位置に合わせて順位を飛ばす（1, 2, 2, 4）
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} kind ランキングの kind 名
+ * @param {int} position 最初のエンティティの位置（1から）
+ * @param {[]*datastore.Key} keys キーのリスト
+ * @param {[]*Entity} entities 並び順に並んだランキングデータ
+ * @returns {[]*RankedEntity} 順位付きのランキングデータ
+ * @returns {error} エラー
+ */
+func (this *Board) rankEntries(c appengine.Context, kind string, position int, keys []*datastore.Key, entities []*Entity) ([]*RankedEntity, error) {
+	var ranked []*RankedEntity
+	var rank int
+	var i int
+	var err error
+	
+	ranked = make([]*RankedEntity, len(entities))
+	if len(entities) == 0 {
+		return ranked, nil
+	}
+	
+	rank, err = this.countRank(c, kind, entities[0])
+	if err != nil {
+		return nil, err
+	}
+	for i = 0; i < len(entities); i++ {
+		if i > 0 && this.rankKey(entities[i]) != this.rankKey(entities[i - 1]) {
+			rank = position + i
+		}
+		ranked[i] = newRankedEntity(rank, keys[i], entities[i])
+	}
+	return ranked, nil
+}
+
+/**
+ * ランキングのエンティティの並び順のキーを計算し直す
+ * 並び順の設定を変えたときや、並び順のキーがない古いエンティティがあるときに呼び出す
+ * 一度に resortBatchSize 件ずつ更新するので、Done が true になるまで Index と Cursor を渡して繰り返し呼び出す
+ * 管理者のみ実行できる
+ * /resortboard?kind=xxxxxx&index=0&cursor=xxxxxx
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func resortBoard(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var board *Board
+	var kinds []string
+	var result *ResortResult
+	var query *datastore.Query
+	var iterator *datastore.Iterator
+	var cursor datastore.Cursor
+	var keys []*datastore.Key
+	var entities []*Entity
+	var key *datastore.Key
+	var entity *Entity
+	var err error
+	
+	c = appengine.NewContext(r)
+	if !requireAdmin(c, w, r) {
+		return
+	}
+	board = requestBoard(c, w, r)
+	if board == nil {
+		return
+	}
+	kinds, err = board.kinds(c)
+	check(c, err)
+	
+	result = new(ResortResult)
+	if r.FormValue("index") != "" {
+		result.Index, err = strconv.Atoi(r.FormValue("index"))
+		if err != nil || result.Index < 0 {
+			writeError(c, w, http.StatusBadRequest, "index が正しくありません")
+			return
+		}
+	}
+	if result.Index >= len(kinds) {
+		result.Done = true
+		writeJSON(c, w, result)
+		return
+	}
+	
+	var kind string
+	kind = kinds[result.Index]
+	query = datastore.NewQuery(kind).Limit(resortBatchSize)
+	if r.FormValue("cursor") != "" {
+		cursor, err = datastore.DecodeCursor(r.FormValue("cursor"))
+		if err != nil {
+			writeError(c, w, http.StatusBadRequest, "cursor が正しくありません")
+			return
+		}
+		query = query.Start(cursor)
+	}
+	
+	iterator = query.Run(c)
+	for {
+		entity = new(Entity)
+		key, err = iterator.Next(entity)
+		if err == datastore.Done {
+			break
+		}
+		check(c, err)
+		if err != nil {
+			writeError(c, w, http.StatusInternalServerError, "エンティティを読み込めませんでした")
+			return
+		}
+		entity.SortKey = board.sortKey(entity)
+		keys = append(keys, key)
+		entities = append(entities, entity)
+	}
+	if len(keys) > 0 {
+		_, err = datastore.PutMulti(c, keys, entities)
+		check(c, err)
+	}
+	result.Updated = len(keys)
+	invalidateTop(c, kind)
+	
+	if len(keys) < resortBatchSize {
+		result.Index++
+		result.Done = result.Index >= len(kinds)
+	} else {
+		cursor, err = iterator.Cursor()
+		check(c, err)
+		result.Cursor = cursor.String()
+	}
+	audit(c, "resortboard", board.ID, kind, fmt.Sprintf("%d件", result.Updated))
+	
+	writeJSON(c, w, result)
+}
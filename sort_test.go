@@ -0,0 +1,124 @@
+package okanoworld
+
+import(
+	"testing"
+	"time"
+)
+
+/**
+ * encodeScore が上位ほど小さい文字列を返すこと（負の得点と得点の低い方が上位のランキングを含む）
+ * @function
+ * @param {*testing.T} t テスト
+ */
+func TestEncodeScore(t *testing.T) {
+	var tests []struct {
+		score int
+		ascending bool
+		encoded string
+	}
+	var orders []struct {
+		ascending bool
+		scores []int
+	}
+	var i, j int
+	
+	tests = []struct {
+		score int
+		ascending bool
+		encoded string
+	}{
+		{0, true, "8000000000000000"},
+		{1, true, "8000000000000001"},
+		{-1, true, "7fffffffffffffff"},
+		{0, false, "7fffffffffffffff"},
+		{1, false, "7ffffffffffffffe"},
+		{-1, false, "8000000000000000"},
+	}
+	for i = 0; i < len(tests); i++ {
+		if encodeScore(tests[i].score, tests[i].ascending) != tests[i].encoded {
+			t.Errorf("encodeScore(%d, %v) = %s, want %s", tests[i].score, tests[i].ascending, encodeScore(tests[i].score, tests[i].ascending), tests[i].encoded)
+		}
+	}
+	
+	// 上位から順に並べた得点
+	orders = []struct {
+		ascending bool
+		scores []int
+	}{
+		{false, []int{1 << 40, 1000, 1, 0, -1, -1000, -1 << 40}},
+		{true, []int{-1 << 40, -1000, -1, 0, 1, 1000, 1 << 40}},
+	}
+	for i = 0; i < len(orders); i++ {
+		for j = 1; j < len(orders[i].scores); j++ {
+			if encodeScore(orders[i].scores[j - 1], orders[i].ascending) >= encodeScore(orders[i].scores[j], orders[i].ascending) {
+				t.Errorf("ascending=%v: %d does not sort before %d", orders[i].ascending, orders[i].scores[j - 1], orders[i].scores[j])
+			}
+		}
+	}
+}
+
+/**
+ * sortKey が同じ順位のデータを登録日時の古い順に並べ、1970 年より前の日時は先頭に並べること
+ * @function
+ * @param {*testing.T} t テスト
+ */
+func TestSortKey(t *testing.T) {
+	var board *Board
+	var entities []*Entity
+	var i int
+	
+	board = new(Board)
+	// 並び順に並べたデータ
+	entities = []*Entity{
+		{Score: 100, Created: time.Date(2013, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{Score: 10},
+		{Score: 10, Created: time.Date(1960, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Score: 10, Created: time.Date(2013, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{Score: 10, Created: time.Date(2013, 6, 1, 0, 0, 0, 1, time.UTC)},
+		{Score: -10, Created: time.Date(2013, 6, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for i = 1; i < len(entities); i++ {
+		if board.sortKey(entities[i - 1]) > board.sortKey(entities[i]) {
+			t.Errorf("entity %d does not sort before entity %d", i - 1, i)
+		}
+	}
+	if board.sortKey(entities[1]) != board.sortKey(entities[2]) {
+		t.Errorf("zero and pre-1970 Created differ: %s, %s", board.sortKey(entities[1]), board.sortKey(entities[2]))
+	}
+	if len(board.sortKey(entities[0])) != 32 {
+		t.Errorf("len(sortKey) = %d, want 32", len(board.sortKey(entities[0])))
+	}
+}
+
+/**
+ * rankKey が得点の後ろに順位の基準を並べ、基準の値がないデータを同じ得点の先頭に並べること
+ * @function
+ * @param {*testing.T} t テスト
+ */
+func TestRankKey(t *testing.T) {
+	var board *Board
+	var entities []*Entity
+	var i int
+	
+	board = &Board{Ascending: true, Criteria: []string{"time:asc", "combo:desc"}}
+	// 並び順に並べたデータ
+	entities = []*Entity{
+		{Score: -5, Values: []int{9000, 0}},
+		{Score: 3},
+		{Score: 3, Values: []int{5000, 20}},
+		{Score: 3, Values: []int{5000, 10}},
+		{Score: 3, Values: []int{5230, 99}},
+		{Score: 4, Values: []int{0, 0}},
+	}
+	for i = 1; i < len(entities); i++ {
+		if board.rankKey(entities[i - 1]) >= board.rankKey(entities[i]) {
+			t.Errorf("entity %d does not rank above entity %d", i - 1, i)
+		}
+		if !board.better(entities[i - 1], entities[i]) {
+			t.Errorf("better(%d, %d) = false, want true", i - 1, i)
+		}
+	}
+	if board.better(entities[2], entities[2]) {
+		t.Errorf("better(x, x) = true, want false")
+	}
+}
@@ -0,0 +1,699 @@
+package okanoworld
+
+import(
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"appengine"
+	"appengine/datastore"
+)
+
+/**
+ * 統計を分割して保存する数
+ * 同時に投稿されても1つのエンティティへの書き込みが集中しないようにする
+ */
+const statsShards = 20
+
+/**
+ * 1つの分割に保存する度数分布の区間の数の上限
+ * これを超えたら区間の幅を2倍にしてまとめ直す
+ */
+const maxStatsBuckets = 5000
+
+/**
+ * rebuildStats で一度に読み込むエンティティの件数
+ */
+const rebuildBatchSize = 500
+
+/**
+ * 百分位数の初期値
+ */
+var defaultPercentiles = []float64{25, 50, 75, 90, 99}
+
+/**
+ * 得点の統計（の一部）
+ * putRanking のたびに全件を読まなくて済むように、登録と削除に合わせて少しずつ更新する
+ * datastore には kind "Stats"、キー名を "kind 名#分割の番号" として保存する
+ * 度数分布は Width ごとの区間に分け、区間の番号（得点 / Width の切り捨て）と件数を並べて保存する
+ * @class
+ * @member {string} Board ランキングの kind 名
+ * @member {string} Kind 集計している kind 名（期間別ランキングなど）
+ * @member {int} Width 度数分布の区間の幅
+ * @member {int64} Count 件数
+ * @member {float64} Sum 得点の合計
+ * @member {[]int64} Buckets 区間の番号（昇順）
+ * @member {[]int64} Counts 区間ごとの件数
+ */
+type Stats struct {
+	Board string
+	Kind string
+	Width int `datastore:",noindex"`
+	Count int64 `datastore:",noindex"`
+	Sum float64 `datastore:",noindex"`
+	Buckets []int64 `datastore:",noindex"`
+	Counts []int64 `datastore:",noindex"`
+}
+
+/**
+ * 百分位数
+ * @member {float64} Percent 百分率
+ * @member {float64} Score 得点
+ */
+type Percentile struct {
+	Percent float64
+	Score float64
+}
+
+/**
+ * ヒストグラムの区間
+ * @member {int} From 区間の最小の得点
+ * @member {int} To 区間の最大の得点
+ * @member {int64} Count 件数
+ */
+type HistogramBucket struct {
+	From int
+	To int
+	Count int64
+}
+
+/**
+ * getStats の応答
+ * 百分位数とヒストグラムは度数分布から求めた近似値
+ * @member {int64} Count 件数
+ * @member {int} Min 最低得点
+ * @member {int} Max 最高得点
+ * @member {float64} Mean 平均
+ * @member {float64} Median 中央値
+ * @member {[]*Percentile} Percentiles 百分位数
+ * @member {[]*HistogramBucket} Histogram ヒストグラム
+ * @member {*float64} Beaten score を指定したとき、その得点が上回っている割合（百分率）
+ */
+type StatsResult struct {
+	Count int64
+	Min int
+	Max int
+	Mean float64
+	Median float64
+	Percentiles []*Percentile
+	Histogram []*HistogramBucket
+	Beaten *float64 `json:",omitempty"`
+}
+
+/**
+ * rebuildStats の応答
+ * @member {int} Counted 集計した件数
+ * @member {string} Cursor 次に呼び出すときに指定するカーソル
+ * @member {bool} Done すべて集計し終わったかどうか
+ */
+type RebuildResult struct {
+	Counted int
+	Cursor string
+	Done bool
+}
+
+/**
+ * 統計の分割のキーを返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} kind 集計している kind 名
+ * @param {int} shard 分割の番号
+ * @returns {*datastore.Key} キー
+ */
+func statsKey(c appengine.Context, kind string, shard int) *datastore.Key {
+	return datastore.NewKey(c, "Stats", fmt.Sprintf("%s#%d", kind, shard), 0, nil)
+}
+
+/**
+ * 得点が入る区間の番号を返す
+ * 負の得点も小さい方へ切り捨てる
+ * @function
+ * @param {int} score 得点
+ * @param {int} width 区間の幅
+ * @returns {int64} 区間の番号
+ */
+func bucketIndex(score int, width int) int64 {
+	var index int64
+	index = int64(score) / int64(width)
+	if int64(score) % int64(width) != 0 && score < 0 {
+		index--
+	}
+	return index
+}
+
+/**
+ * 度数分布に件数を加える
+ * @method
+ * @memberof Stats
+ * @param {int64} index 区間の番号
+ * @param {int64} count 加える件数（負なら減らす）
+ */
+func (this *Stats) add(index int64, count int64) {
+	var i int
+	i = sort.Search(len(this.Buckets), func(i int) bool {
+		return this.Buckets[i] >= index
+	})
+	if i < len(this.Buckets) && this.Buckets[i] == index {
+		this.Counts[i] += count
+		if this.Counts[i] == 0 {
+			this.Buckets = append(this.Buckets[:i], this.Buckets[i + 1:]...)
+			this.Counts = append(this.Counts[:i], this.Counts[i + 1:]...)
+		}
+		return
+	}
+	this.Buckets = append(this.Buckets, 0)
+	this.Counts = append(this.Counts, 0)
+	copy(this.Buckets[i + 1:], this.Buckets[i:])
+	copy(this.Counts[i + 1:], this.Counts[i:])
+	this.Buckets[i] = index
+	this.Counts[i] = count
+}
+
+/**
+ * 区間の幅を変えて度数分布をまとめ直す
+ * 幅は今の幅の倍数にする
+ * @method
+ * @memberof Stats
+ * @param {int} width 新しい区間の幅
+ */
+func (this *Stats) rebucket(width int) {
+	var buckets []int64
+	var counts []int64
+	var i int
+	
+	if width == this.Width {
+		return
+	}
+	buckets = this.Buckets
+	counts = this.Counts
+	this.Buckets = make([]int64, 0, len(buckets))
+	this.Counts = make([]int64, 0, len(counts))
+	for i = 0; i < len(buckets); i++ {
+		this.add(bucketIndex(int(buckets[i] * int64(this.Width)), width), counts[i])
+	}
+	this.Width = width
+}
+
+/**
+ * 得点を統計に加える（または取り除く）
+ * @method
+ * @memberof Stats
+ * @param {int} score 得点
+ * @param {int64} count 1なら加え、-1なら取り除く
+ */
+func (this *Stats) record(score int, count int64) {
+	this.Count += count
+	this.Sum += float64(score) * float64(count)
+	this.add(bucketIndex(score, this.Width), count)
+	for len(this.Buckets) > maxStatsBuckets {
+		this.rebucket(this.Width * 2)
+	}
+}
+
+/**
+ * 分割して保存した統計をまとめる
+ * 区間の幅が違う分割は一番広い幅にそろえる
+ * 別の分割で取り除いた分があるので、まとめた後に件数が0以下の区間は捨てる
+ * @function
+ * @param {[]*Stats} shards 統計の分割
+ * @returns {*Stats} まとめた統計
+ */
+func mergeStats(shards []*Stats) *Stats {
+	var merged *Stats
+	var i, j int
+	
+	merged = new(Stats)
+	merged.Width = 1
+	for i = 0; i < len(shards); i++ {
+		if shards[i].Width > merged.Width {
+			merged.Width = shards[i].Width
+		}
+	}
+	for i = 0; i < len(shards); i++ {
+		shards[i].rebucket(merged.Width)
+		merged.Count += shards[i].Count
+		merged.Sum += shards[i].Sum
+		for j = 0; j < len(shards[i].Buckets); j++ {
+			merged.add(shards[i].Buckets[j], shards[i].Counts[j])
+		}
+	}
+	for i = len(merged.Buckets) - 1; i >= 0; i-- {
+		if merged.Counts[i] < 0 {
+			merged.Buckets = append(merged.Buckets[:i], merged.Buckets[i + 1:]...)
+			merged.Counts = append(merged.Counts[:i], merged.Counts[i + 1:]...)
+		}
+	}
+	return merged
+}
+
+/**
+ * 得点が x 未満のエンティティの件数を度数分布から見積もる
+ * 区間の中では得点が均等に散らばっているものとして按分する
+ * @method
+ * @memberof Stats
+ * @param {float64} x 得点
+ * @returns {float64} 件数
+ */
+func (this *Stats) below(x float64) float64 {
+	var total float64
+	var from float64
+	var i int
+	
+	for i = 0; i < len(this.Buckets); i++ {
+		from = float64(this.Buckets[i] * int64(this.Width))
+		if x <= from {
+			break
+		}
+		if x >= from + float64(this.Width) {
+			total += float64(this.Counts[i])
+		} else {
+			total += float64(this.Counts[i]) * (x - from) / float64(this.Width)
+		}
+	}
+	return total
+}
+
+/**
+ * 得点が score より上位のエンティティの件数を度数分布から見積もる
+ * @method
+ * @memberof Stats
+ * @param {int} score 得点
+ * @param {bool} ascending 得点の低い方が上位なら true
+ * @returns {float64} 件数
+ */
+func (this *Stats) ahead(score int, ascending bool) float64 {
+	if ascending {
+		return this.below(float64(score))
+	}
+	return float64(this.Count) - this.below(float64(score) + 1)
+}
+
+/**
+ * 百分位数を度数分布から見積もる
+ * @method
+ * @memberof Stats
+ * @param {float64} percent 百分率
+ * @returns {float64} 得点
+ */
+func (this *Stats) percentile(percent float64) float64 {
+	var target float64
+	var total float64
+	var from float64
+	var i int
+	
+	for i = 0; i < len(this.Counts); i++ {
+		total += float64(this.Counts[i])
+	}
+	if total == 0 {
+		return 0
+	}
+	target = total * percent / 100
+	for i = 0; i < len(this.Buckets); i++ {
+		from = float64(this.Buckets[i] * int64(this.Width))
+		if target <= float64(this.Counts[i]) {
+			return from + float64(this.Width) * target / float64(this.Counts[i])
+		}
+		target -= float64(this.Counts[i])
+	}
+	return float64((this.Buckets[len(this.Buckets) - 1] + 1) * int64(this.Width))
+}
+
+/**
+ * 統計を更新する
+ * 分割のうち1つを選んでトランザクション内で更新する
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} kind 集計している kind 名
+ * @param {[]*Entity} added 加えたエンティティ
+ * @param {[]*Entity} removed 取り除いたエンティティ
+ * @returns {error} エラー
+ */
+func (this *Board) updateStats(c appengine.Context, kind string, added []*Entity, removed []*Entity) error {
+	var key *datastore.Key
+	
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+	key = statsKey(c, kind, rand.Intn(statsShards))
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var stats *Stats
+		var i int
+		var err error
+		
+		stats = new(Stats)
+		err = datastore.Get(c, key, stats)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if err == datastore.ErrNoSuchEntity {
+			stats.Board = this.ID
+			stats.Kind = kind
+			stats.Width = this.statsWidth()
+		}
+		for i = 0; i < len(added); i++ {
+			stats.record(added[i].Score, 1)
+		}
+		for i = 0; i < len(removed); i++ {
+			stats.record(removed[i].Score, -1)
+		}
+		_, err = datastore.Put(c, key, stats)
+		return err
+	}, nil)
+}
+
+/**
+ * 度数分布の区間の幅の初期値を返す
+ * StatsBucketSize が指定されていなければ、得点の範囲を1000に分けた幅（範囲がなければ1）にする
+ * @method
+ * @memberof Board
+ * @returns {int} 区間の幅
+ */
+func (this *Board) statsWidth() int {
+	var width int
+	if this.StatsBucketSize > 0 {
+		return this.StatsBucketSize
+	}
+	width = 1
+	if this.MaxScore > this.MinScore {
+		width = (this.MaxScore - this.MinScore) / 1000
+	}
+	if width < 1 {
+		width = 1
+	}
+	return width
+}
+
+/**
+ * 統計を読み込んで1つにまとめる
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} kind 集計している kind 名
+ * @returns {*Stats} まとめた統計
+ * @returns {error} エラー
+ */
+func loadStats(c appengine.Context, kind string) (*Stats, error) {
+	var keys []*datastore.Key
+	var shards []*Stats
+	var found []*Stats
+	var errs datastore.MultiError
+	var ok bool
+	var i int
+	var err error
+	
+	keys = make([]*datastore.Key, statsShards)
+	shards = make([]*Stats, statsShards)
+	for i = 0; i < statsShards; i++ {
+		keys[i] = statsKey(c, kind, i)
+		shards[i] = new(Stats)
+	}
+	err = datastore.GetMulti(c, keys, shards)
+	errs, ok = err.(datastore.MultiError)
+	if err != nil && !ok {
+		return nil, err
+	}
+	found = make([]*Stats, 0, statsShards)
+	for i = 0; i < statsShards; i++ {
+		if err == nil || errs[i] == nil {
+			found = append(found, shards[i])
+		} else if errs[i] != datastore.ErrNoSuchEntity {
+			return nil, errs[i]
+		}
+	}
+	return mergeStats(found), nil
+}
+
+/**
+ * 統計を削除する
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} kind 集計している kind 名
+ * @returns {error} エラー
+ */
+func deleteStats(c appengine.Context, kind string) error {
+	var keys []*datastore.Key
+	var i int
+	
+	keys = make([]*datastore.Key, statsShards)
+	for i = 0; i < statsShards; i++ {
+		keys[i] = statsKey(c, kind, i)
+	}
+	return datastore.DeleteMulti(c, keys)
+}
+
+/**
+ * ランキングの得点の統計を削除する
+ * wipeBoard で削除した kind の統計だけを消し、シーズンとアーカイブの統計は残す
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @returns {error} エラー
+ */
+func (this *Board) wipeStats(c appengine.Context) error {
+	var keys []*datastore.Key
+	var shards []*Stats
+	var targets []*datastore.Key
+	var i int
+	var err error
+	
+	keys, err = datastore.NewQuery("Stats").Filter("Board =", this.ID).GetAll(c, &shards)
+	if err != nil {
+		return err
+	}
+	targets = make([]*datastore.Key, 0, len(keys))
+	for i = 0; i < len(keys); i++ {
+		if strings.Contains(shards[i].Kind, "@season:") || strings.Contains(shards[i].Kind, "@archive:") {
+			continue
+		}
+		targets = append(targets, keys[i])
+	}
+	return datastore.DeleteMulti(c, targets)
+}
+
+/**
+ * 得点の統計を取得する
+ * percentiles で百分位数を、buckets でヒストグラムの区間の数を指定する（省略時は 25,50,75,90,99 と10区間）
+ * score を指定すると、その得点が上回っている割合を Beaten で返す
+ * /getstats?kind=xxxxxx&percentiles=50,90,99&buckets=20&score=1000
+ * period と date で期間別ランキングの統計を取得できる
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func getStats(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var board *Board
+	var kind string
+	var percents []float64
+	var buckets int
+	var stats *Stats
+	var result *StatsResult
+	var i int
+	var err error
+	
+	c = appengine.NewContext(r)
+	board = requestBoard(c, w, r)
+	if board == nil {
+		return
+	}
+	kind, err = board.requestKind(c, r)
+	if err != nil {
+		writeError(c, w, http.StatusBadRequest, err.Error())
+		return
+	}
+	
+	percents = defaultPercentiles
+	if r.FormValue("percentiles") != "" {
+		var values []string
+		values = strings.Split(r.FormValue("percentiles"), ",")
+		percents = make([]float64, len(values))
+		for i = 0; i < len(values); i++ {
+			percents[i], err = strconv.ParseFloat(values[i], 64)
+			if err != nil || percents[i] < 0 || percents[i] > 100 {
+				writeError(c, w, http.StatusBadRequest, "percentiles は0から100で指定してください")
+				return
+			}
+		}
+	}
+	buckets = 10
+	if r.FormValue("buckets") != "" {
+		buckets, err = strconv.Atoi(r.FormValue("buckets"))
+		if err != nil || buckets < 1 || buckets > 100 {
+			writeError(c, w, http.StatusBadRequest, "buckets は1から100で指定してください")
+			return
+		}
+	}
+	
+	stats, err = loadStats(c, kind)
+	check(c, err)
+	if err != nil {
+		writeError(c, w, http.StatusInternalServerError, "統計を読み込めませんでした")
+		return
+	}
+	
+	result = new(StatsResult)
+	result.Percentiles = make([]*Percentile, 0, len(percents))
+	result.Histogram = make([]*HistogramBucket, 0, buckets)
+	result.Count = stats.Count
+	if stats.Count <= 0 {
+		writeJSON(c, w, result)
+		return
+	}
+	result.Mean = stats.Sum / float64(stats.Count)
+	
+	// 最高得点と最低得点は並び順の両端を読んで正確に求める
+	var first, last []*Entity
+	_, err = datastore.NewQuery(kind).Order(sortOrder).Limit(1).GetAll(c, &first)
+	check(c, err)
+	_, err = datastore.NewQuery(kind).Order(reverseSortOrder).Limit(1).GetAll(c, &last)
+	check(c, err)
+	if len(first) > 0 && len(last) > 0 {
+		result.Min = first[0].Score
+		result.Max = last[0].Score
+		if result.Min > result.Max {
+			result.Min, result.Max = result.Max, result.Min
+		}
+	}
+	
+	result.Median = clamp(stats.percentile(50), result.Min, result.Max)
+	for i = 0; i < len(percents); i++ {
+		result.Percentiles = append(result.Percentiles, &Percentile{percents[i], clamp(stats.percentile(percents[i]), result.Min, result.Max)})
+	}
+	
+	// 最低得点から最高得点までを buckets 個の区間に分ける
+	var size int
+	var from float64
+	size = (result.Max - result.Min + buckets) / buckets
+	for i = 0; i < buckets && result.Min + size * i <= result.Max; i++ {
+		var bucket *HistogramBucket
+		bucket = new(HistogramBucket)
+		bucket.From = result.Min + size * i
+		bucket.To = bucket.From + size - 1
+		from = float64(bucket.From)
+		if i == 0 {
+			from = math.Inf(-1)
+		}
+		bucket.Count = int64(math.Floor(stats.below(float64(bucket.To) + 1) - stats.below(from) + 0.5))
+		if bucket.To >= result.Max {
+			bucket.Count = int64(math.Floor(float64(stats.Count) - stats.below(from) + 0.5))
+		}
+		result.Histogram = append(result.Histogram, bucket)
+	}
+	
+	if r.FormValue("score") != "" {
+		var score int
+		var beaten float64
+		score, err = strconv.Atoi(r.FormValue("score"))
+		if err != nil {
+			writeError(c, w, http.StatusBadRequest, "score が正しくありません")
+			return
+		}
+		if board.Ascending {
+			beaten = float64(stats.Count) - stats.below(float64(score) + 1)
+		} else {
+			beaten = stats.below(float64(score))
+		}
+		beaten = math.Max(0, math.Min(100, beaten * 100 / float64(stats.Count)))
+		result.Beaten = &beaten
+	}
+	
+	writeJSON(c, w, result)
+}
+
+/**
+ * 値を範囲内に収める
+ * @function
+ * @param {float64} value 値
+ * @param {int} min 最小値
+ * @param {int} max 最大値
+ * @returns {float64} 範囲内に収めた値
+ */
+func clamp(value float64, min int, max int) float64 {
+	return math.Max(float64(min), math.Min(float64(max), value))
+}
+
+/**
+ * 得点の統計を集計し直す
+ * 統計の区間の幅を変えたときや、統計を記録する前からあるランキングで呼び出す
+ * cursor を指定せずに呼び出すと統計を削除して最初から集計する
+ * 一度に rebuildBatchSize 件ずつ集計するので、Done が true になるまで Cursor を渡して繰り返し呼び出す
+ * 管理者のみ実行できる
+ * /rebuildstats?kind=xxxxxx&period=week&cursor=xxxxxx
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func rebuildStats(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var board *Board
+	var kind string
+	var query *datastore.Query
+	var iterator *datastore.Iterator
+	var cursor datastore.Cursor
+	var entities []*Entity
+	var entity *Entity
+	var result *RebuildResult
+	var err error
+	
+	c = appengine.NewContext(r)
+	if !requireAdmin(c, w, r) {
+		return
+	}
+	board = requestBoard(c, w, r)
+	if board == nil {
+		return
+	}
+	kind, err = board.requestKind(c, r)
+	if err != nil {
+		writeError(c, w, http.StatusBadRequest, err.Error())
+		return
+	}
+	
+	query = datastore.NewQuery(kind).Limit(rebuildBatchSize)
+	if r.FormValue("cursor") != "" {
+		cursor, err = datastore.DecodeCursor(r.FormValue("cursor"))
+		if err != nil {
+			writeError(c, w, http.StatusBadRequest, "cursor が正しくありません")
+			return
+		}
+		query = query.Start(cursor)
+	} else {
+		err = deleteStats(c, kind)
+		check(c, err)
+		audit(c, "rebuildstats", board.ID, kind, "")
+	}
+	
+	iterator = query.Run(c)
+	for {
+		entity = new(Entity)
+		_, err = iterator.Next(entity)
+		if err == datastore.Done {
+			break
+		}
+		check(c, err)
+		if err != nil {
+			writeError(c, w, http.StatusInternalServerError, "エンティティを読み込めませんでした")
+			return
+		}
+		entities = append(entities, entity)
+	}
+	err = board.updateStats(c, kind, entities, nil)
+	check(c, err)
+	if err != nil {
+		writeError(c, w, http.StatusInternalServerError, "統計を保存できませんでした")
+		return
+	}
+	
+	result = new(RebuildResult)
+	result.Counted = len(entities)
+	result.Done = len(entities) < rebuildBatchSize
+	if !result.Done {
+		cursor, err = iterator.Cursor()
+		check(c, err)
+		result.Cursor = cursor.String()
+	}
+	writeJSON(c, w, result)
+}
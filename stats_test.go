@@ -0,0 +1,249 @@
+package okanoworld
+
+import(
+	"reflect"
+	"testing"
+)
+
+/**
+ * bucketIndex が負の得点も小さい方へ切り捨てること
+ * @function
+ * @param {*testing.T} t テスト
+ */
+func TestBucketIndex(t *testing.T) {
+	var tests []struct {
+		score int
+		width int
+		index int64
+	}
+	var i int
+	
+	tests = []struct {
+		score int
+		width int
+		index int64
+	}{
+		{0, 1, 0},
+		{5, 1, 5},
+		{-5, 1, -5},
+		{9, 10, 0},
+		{10, 10, 1},
+		{-1, 10, -1},
+		{-10, 10, -1},
+		{-11, 10, -2},
+	}
+	for i = 0; i < len(tests); i++ {
+		if bucketIndex(tests[i].score, tests[i].width) != tests[i].index {
+			t.Errorf("bucketIndex(%d, %d) = %d, want %d", tests[i].score, tests[i].width, bucketIndex(tests[i].score, tests[i].width), tests[i].index)
+		}
+	}
+}
+
+/**
+ * record で加えた得点と取り除いた得点が度数分布に反映され、件数が0の区間は残らないこと
+ * @function
+ * @param {*testing.T} t テスト
+ */
+func TestStatsRecord(t *testing.T) {
+	var tests []struct {
+		name string
+		scores []int
+		removed []int
+		buckets []int64
+		counts []int64
+	}
+	var stats *Stats
+	var i, j int
+	
+	tests = []struct {
+		name string
+		scores []int
+		removed []int
+		buckets []int64
+		counts []int64
+	}{
+		{"empty", nil, nil, []int64{}, []int64{}},
+		{"sorted", []int{30, 10, 20, 10}, nil, []int64{1, 2, 3}, []int64{2, 1, 1}},
+		{"negative", []int{-5, 5, -15}, nil, []int64{-2, -1, 0}, []int64{1, 1, 1}},
+		{"removed", []int{10, 20}, []int{20}, []int64{1}, []int64{1}},
+		{"removed all", []int{10}, []int{10}, []int64{}, []int64{}},
+	}
+	for i = 0; i < len(tests); i++ {
+		stats = &Stats{Width: 10, Buckets: []int64{}, Counts: []int64{}}
+		for j = 0; j < len(tests[i].scores); j++ {
+			stats.record(tests[i].scores[j], 1)
+		}
+		for j = 0; j < len(tests[i].removed); j++ {
+			stats.record(tests[i].removed[j], -1)
+		}
+		if !reflect.DeepEqual(stats.Buckets, tests[i].buckets) || !reflect.DeepEqual(stats.Counts, tests[i].counts) {
+			t.Errorf("%s: Buckets, Counts = %v, %v, want %v, %v", tests[i].name, stats.Buckets, stats.Counts, tests[i].buckets, tests[i].counts)
+		}
+		if stats.Count != int64(len(tests[i].scores) - len(tests[i].removed)) {
+			t.Errorf("%s: Count = %d, want %d", tests[i].name, stats.Count, len(tests[i].scores) - len(tests[i].removed))
+		}
+	}
+}
+
+/**
+ * rebucket で区間の幅を広げても件数が保たれ、負の区間も正しくまとまること
+ * @function
+ * @param {*testing.T} t テスト
+ */
+func TestStatsRebucket(t *testing.T) {
+	var tests []struct {
+		width int
+		buckets []int64
+		counts []int64
+	}
+	var stats *Stats
+	var i int
+	
+	tests = []struct {
+		width int
+		buckets []int64
+		counts []int64
+	}{
+		{1, []int64{-3, -2, -1, 0, 1, 2, 3}, []int64{1, 1, 1, 1, 1, 1, 1}},
+		{2, []int64{-2, -1, 0, 1}, []int64{1, 2, 2, 2}},
+		{4, []int64{-1, 0}, []int64{3, 4}},
+	}
+	for i = 0; i < len(tests); i++ {
+		stats = &Stats{Width: 1}
+		stats.Buckets = []int64{-3, -2, -1, 0, 1, 2, 3}
+		stats.Counts = []int64{1, 1, 1, 1, 1, 1, 1}
+		stats.rebucket(tests[i].width)
+		if stats.Width != tests[i].width {
+			t.Errorf("rebucket(%d): Width = %d", tests[i].width, stats.Width)
+		}
+		if !reflect.DeepEqual(stats.Buckets, tests[i].buckets) || !reflect.DeepEqual(stats.Counts, tests[i].counts) {
+			t.Errorf("rebucket(%d): Buckets, Counts = %v, %v, want %v, %v", tests[i].width, stats.Buckets, stats.Counts, tests[i].buckets, tests[i].counts)
+		}
+	}
+}
+
+/**
+ * 区間の数が maxStatsBuckets を超えると record が幅を広げること
+ * @function
+ * @param {*testing.T} t テスト
+ */
+func TestStatsRecordRebucket(t *testing.T) {
+	var stats *Stats
+	var i int
+	
+	stats = &Stats{Width: 1}
+	for i = 0; i <= maxStatsBuckets; i++ {
+		stats.record(i, 1)
+	}
+	if stats.Width != 2 {
+		t.Errorf("Width = %d, want 2", stats.Width)
+	}
+	if len(stats.Buckets) > maxStatsBuckets {
+		t.Errorf("len(Buckets) = %d, want <= %d", len(stats.Buckets), maxStatsBuckets)
+	}
+	if stats.Count != maxStatsBuckets + 1 {
+		t.Errorf("Count = %d, want %d", stats.Count, maxStatsBuckets + 1)
+	}
+}
+
+/**
+ * mergeStats が幅の違う分割を一番広い幅にそろえ、件数が負になった区間を捨てること
+ * @function
+ * @param {*testing.T} t テスト
+ */
+func TestMergeStats(t *testing.T) {
+	var merged *Stats
+	
+	merged = mergeStats([]*Stats{
+		{Width: 1, Count: 3, Sum: 6, Buckets: []int64{1, 2, 3}, Counts: []int64{1, 1, 1}},
+		{Width: 2, Count: 1, Sum: 5, Buckets: []int64{2}, Counts: []int64{1}},
+		{Width: 1, Count: -1, Sum: -8, Buckets: []int64{8}, Counts: []int64{-1}},
+	})
+	if merged.Width != 2 {
+		t.Errorf("Width = %d, want 2", merged.Width)
+	}
+	if merged.Count != 3 || merged.Sum != 3 {
+		t.Errorf("Count, Sum = %d, %v, want 3, 3", merged.Count, merged.Sum)
+	}
+	if !reflect.DeepEqual(merged.Buckets, []int64{0, 1, 2}) || !reflect.DeepEqual(merged.Counts, []int64{1, 2, 1}) {
+		t.Errorf("Buckets, Counts = %v, %v, want [0 1 2], [1 2 1]", merged.Buckets, merged.Counts)
+	}
+}
+
+/**
+ * below、ahead、percentile が度数分布から件数と得点を見積もること
+ * @function
+ * @param {*testing.T} t テスト
+ */
+func TestStatsEstimates(t *testing.T) {
+	var stats *Stats
+	var below []struct {
+		x float64
+		count float64
+	}
+	var ahead []struct {
+		score int
+		ascending bool
+		count float64
+	}
+	var percentiles []struct {
+		percent float64
+		score float64
+	}
+	var i int
+	
+	// 得点 -10 から 29 まで 10 点ごとに 10 件ずつ
+	stats = &Stats{Width: 10, Count: 40, Buckets: []int64{-1, 0, 1, 2}, Counts: []int64{10, 10, 10, 10}}
+	below = []struct {
+		x float64
+		count float64
+	}{
+		{-20, 0},
+		{-10, 0},
+		{-5, 5},
+		{0, 10},
+		{15, 25},
+		{30, 40},
+		{100, 40},
+	}
+	for i = 0; i < len(below); i++ {
+		if stats.below(below[i].x) != below[i].count {
+			t.Errorf("below(%v) = %v, want %v", below[i].x, stats.below(below[i].x), below[i].count)
+		}
+	}
+	
+	ahead = []struct {
+		score int
+		ascending bool
+		count float64
+	}{
+		{29, false, 0},
+		{9, false, 20},
+		{-10, false, 39},
+		{-10, true, 0},
+		{10, true, 20},
+	}
+	for i = 0; i < len(ahead); i++ {
+		if stats.ahead(ahead[i].score, ahead[i].ascending) != ahead[i].count {
+			t.Errorf("ahead(%d, %v) = %v, want %v", ahead[i].score, ahead[i].ascending, stats.ahead(ahead[i].score, ahead[i].ascending), ahead[i].count)
+		}
+	}
+	
+	percentiles = []struct {
+		percent float64
+		score float64
+	}{
+		{0, -10},
+		{25, 0},
+		{50, 10},
+		{100, 30},
+	}
+	for i = 0; i < len(percentiles); i++ {
+		if stats.percentile(percentiles[i].percent) != percentiles[i].score {
+			t.Errorf("percentile(%v) = %v, want %v", percentiles[i].percent, stats.percentile(percentiles[i].percent), percentiles[i].score)
+		}
+	}
+	if (&Stats{Width: 1}).percentile(50) != 0 {
+		t.Errorf("percentile of empty stats is not 0")
+	}
+}
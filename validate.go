@@ -0,0 +1,175 @@
+package okanoworld
+
+import(
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+	"unicode/utf8"
+	"appengine"
+	"appengine/datastore"
+)
+
+/**
+ * 受け付けなかった送信の記録
+ * 後で確認できるように datastore に kind "Rejection"、ランキングの設定のキーを親として保存する
+ * @class
+ * @member {string} Name プレイヤー名
+ * @member {int} Score 得点
+ * @member {string} Field 問題のあった項目（name, score）
+ * @member {string} Rule 違反したルール（range, gain, length, charset）
+ * @member {string} Message エラーメッセージ
+ * @member {string} RemoteAddr 送信元のアドレス
+ * @member {time.Time} Created 送信日時
+ */
+type Rejection struct {
+	Name string
+	Score int
+	Field string
+	Rule string
+	Message string
+	RemoteAddr string
+	Created time.Time
+}
+
+/**
+ * putRanking で送信されたデータをランキングのルールで検査する
+ * プレイヤーとして送信したデータは Name がプレイヤーIDなので名前のルールは検査しない
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @param {*Entity} entity 登録するデータ
+ * @returns {*Rejection} ルールに違反していればその内容、問題なければ nil
+ */
+func (this *Board) validate(c appengine.Context, entity *Entity) *Rejection {
+	var length int
+	var err error
+	
+	length = utf8.RuneCountInString(entity.Name)
+	if entity.Player == "" && (length < this.NameMinLength || (this.NameMaxLength > 0 && length > this.NameMaxLength)) {
+		return newRejection(entity, "name", "length", "name の長さが正しくありません")
+	}
+	if entity.Player == "" && this.NamePattern != "" {
+		var pattern *regexp.Regexp
+		pattern, err = regexp.Compile(this.NamePattern)
+		check(c, err)
+		if err == nil && !pattern.MatchString(entity.Name) {
+			return newRejection(entity, "name", "charset", "name に使えない文字が含まれています")
+		}
+	}
+	
+	if !this.inRange(entity.Score) {
+		return newRejection(entity, "score", "range", "score が受け付ける範囲を超えています")
+	}
+	
+	if this.MaxGainPerMinute > 0 && entity.Name != "" {
+		var previous *Entity
+		var gain int
+		var minutes float64
+		_, previous, err = findEntry(c, this, this.ID, "", entity.Name)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			check(c, err)
+		}
+		if err == nil {
+			gain = entity.Score - previous.Score
+			if this.Ascending {
+				gain = -gain
+			}
+			minutes = entity.Created.Sub(previous.Created).Minutes()
+			if minutes < 1 {
+				minutes = 1
+			}
+			if float64(gain) / minutes > float64(this.MaxGainPerMinute) {
+				return newRejection(entity, "score", "gain", "前回の記録からの伸びが大きすぎます")
+			}
+		}
+	}
+	
+	return nil
+}
+
+/**
+ * Rejection を作成する
+ * @function
+ * @param {*Entity} entity 送信されたデータ
+ * @param {string} field 問題のあった項目
+ * @param {string} rule 違反したルール
+ * @param {string} message エラーメッセージ
+ * @returns {*Rejection} 受け付けなかった送信の記録
+ */
+func newRejection(entity *Entity, field string, rule string, message string) *Rejection {
+	var rejection *Rejection
+	rejection = new(Rejection)
+	rejection.Name = entity.Name
+	rejection.Score = entity.Score
+	rejection.Field = field
+	rejection.Rule = rule
+	rejection.Message = message
+	rejection.Created = entity.Created
+	return rejection
+}
+
+/**
+ * 受け付けなかった送信を記録して、エラーを応答する
+ * @method
+ * @memberof Board
+ * @param {appengine.Context} c コンテキスト
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @param {*Rejection} rejection 受け付けなかった送信の記録
+ */
+func (this *Board) reject(c appengine.Context, w http.ResponseWriter, r *http.Request, rejection *Rejection) {
+	var err error
+	
+	rejection.RemoteAddr = r.RemoteAddr
+	c.Warningf("rejected %s: %s %d (%s)", this.ID, rejection.Name, rejection.Score, rejection.Rule)
+	_, err = datastore.Put(c, datastore.NewIncompleteKey(c, "Rejection", boardKey(c, this.ID)), rejection)
+	check(c, err)
+	
+	var result = map[string]string{
+		"Error": rejection.Message,
+		"Field": rejection.Field,
+		"Rule": rejection.Rule,
+	}
+	writeJSONStatus(c, w, http.StatusBadRequest, result)
+}
+
+/**
+ * 受け付けなかった送信の一覧を新しい順に取得する
+ * 管理者のみ実行できる
+ * /getrejections?kind=xxxxxx&limit=100
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func getRejections(w http.ResponseWriter, r *http.Request) {
+	var c appengine.Context
+	var board *Board
+	var limit int
+	var rejections []*Rejection
+	var err error
+	
+	c = appengine.NewContext(r)
+	if !requireAdmin(c, w, r) {
+		return
+	}
+	board = requestBoard(c, w, r)
+	if board == nil {
+		return
+	}
+	
+	limit = 100
+	if r.FormValue("limit") != "" {
+		limit, err = strconv.Atoi(r.FormValue("limit"))
+		if err != nil || limit <= 0 {
+			writeError(c, w, http.StatusBadRequest, "limit が正しくありません")
+			return
+		}
+	}
+	
+	rejections = make([]*Rejection, 0)
+	_, err = datastore.NewQuery("Rejection").Ancestor(boardKey(c, board.ID)).Order("-Created").Limit(limit).GetAll(c, &rejections)
+	check(c, err)
+	
+	writeJSON(c, w, rejections)
+}